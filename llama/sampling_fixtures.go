@@ -0,0 +1,53 @@
+//go:build samplingfixtures
+
+package llama
+
+/*
+#include <stdlib.h>
+#include "llama.h"
+*/
+import "C"
+
+import "unsafe"
+
+// samplingChain applies llama.cpp's default sampler chain of top_k, top_p,
+// min_p and temperature to logits and returns the remaining token ids and
+// their scaled logits. A temperature of 0 applies greedy sampling instead.
+func samplingChain(logits []float32, topK int, topP, minP, temp float32) ([]int32, []float32) {
+	chain := C.llama_sampler_chain_init(C.llama_sampler_chain_default_params())
+	defer C.llama_sampler_free(chain)
+
+	if temp == 0 {
+		C.llama_sampler_chain_add(chain, C.llama_sampler_init_greedy())
+	} else {
+		C.llama_sampler_chain_add(chain, C.llama_sampler_init_top_k(C.int32_t(topK)))
+		C.llama_sampler_chain_add(chain, C.llama_sampler_init_top_p(C.float(topP), 1))
+		C.llama_sampler_chain_add(chain, C.llama_sampler_init_min_p(C.float(minP), 1))
+		C.llama_sampler_chain_add(chain, C.llama_sampler_init_temp(C.float(temp)))
+	}
+
+	data := (*C.llama_token_data)(C.malloc(C.size_t(len(logits)) * C.size_t(unsafe.Sizeof(C.llama_token_data{}))))
+	defer C.free(unsafe.Pointer(data))
+
+	tds := unsafe.Slice(data, len(logits))
+	for i := range logits {
+		tds[i] = C.llama_token_data{id: C.llama_token(i), logit: C.float(logits[i])}
+	}
+
+	cur := C.llama_token_data_array{data: data, size: C.size_t(len(logits)), selected: -1}
+	C.llama_sampler_apply(chain, &cur)
+
+	tds = unsafe.Slice(cur.data, cur.size)
+	if temp == 0 {
+		return []int32{int32(tds[cur.selected].id)}, []float32{float32(tds[cur.selected].logit)}
+	}
+
+	ids := make([]int32, len(tds))
+	values := make([]float32, len(tds))
+	for i, td := range tds {
+		ids[i] = int32(td.id)
+		values[i] = float32(td.logit)
+	}
+
+	return ids, values
+}
@@ -0,0 +1,78 @@
+//go:build samplingfixtures
+
+package llama
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestSamplingFixtures regenerates the reference outputs used to check the
+// sample package against llama.cpp. To add a fixture, add a case below and run
+//
+//	go test -tags samplingfixtures -run TestSamplingFixtures ./llama
+func TestSamplingFixtures(t *testing.T) {
+	type fixture struct {
+		Name        string    `json:"name"`
+		Logits      []float32 `json:"logits"`
+		TopK        int       `json:"top_k"`
+		TopP        float32   `json:"top_p"`
+		MinP        float32   `json:"min_p"`
+		Temperature float32   `json:"temperature"`
+		Tokens      []int32   `json:"tokens"`
+		Probs       []float32 `json:"probs"`
+	}
+
+	fixtures := []fixture{
+		{Name: "defaults", TopK: 40, TopP: 0.95, MinP: 0.05, Temperature: 0.8},
+		{Name: "top_k", TopK: 5, TopP: 1, Temperature: 1},
+		{Name: "top_p", TopP: 0.5, Temperature: 1},
+		{Name: "min_p", TopP: 1, MinP: 0.2, Temperature: 1},
+		{Name: "low_temperature", TopK: 20, TopP: 0.9, MinP: 0.1, Temperature: 0.3},
+		{Name: "high_temperature", TopP: 0.8, MinP: 0.02, Temperature: 2},
+		{Name: "top_k_min_p", TopK: 8, TopP: 1, MinP: 0.3, Temperature: 0.7},
+		{Name: "greedy"},
+	}
+
+	for i := range fixtures {
+		f := &fixtures[i]
+
+		rng := rand.New(rand.NewPCG(uint64(i), 7))
+		f.Logits = make([]float32, 64)
+		for j := range f.Logits {
+			f.Logits[j] = float32(math.Round(rng.NormFloat64()*3000) / 1000)
+		}
+
+		var values []float32
+		f.Tokens, values = samplingChain(f.Logits, f.TopK, f.TopP, f.MinP, f.Temperature)
+
+		// normalize the remaining logits to compare with the sample package
+		maxLogit := float32(math.Inf(-1))
+		for _, v := range values {
+			maxLogit = max(maxLogit, v)
+		}
+
+		var sum float64
+		for _, v := range values {
+			sum += math.Exp(float64(v - maxLogit))
+		}
+
+		f.Probs = make([]float32, len(values))
+		for j, v := range values {
+			f.Probs[j] = float32(math.Exp(float64(v-maxLogit)) / sum)
+		}
+	}
+
+	b, err := json.MarshalIndent(fixtures, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join("..", "sample", "testdata", "llama.cpp.json"), append(b, '\n'), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"hash/maphash"
 	"log"
 	"log/slog"
+	"math"
 	"net"
 	"net/http"
 	"os"
@@ -704,6 +705,76 @@ func (s *Server) health(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+type SampleResponse struct {
+	Token   int32   `json:"token"`
+	Logprob float32 `json:"logprob"`
+}
+
+// sampleLogits is a debugging endpoint that samples a token from the JSON array
+// of logits in the request body using sampler options from the query parameters
+func sampleLogits(w http.ResponseWriter, r *http.Request) {
+	var logits []float32
+	if err := json.NewDecoder(r.Body).Decode(&logits); err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode logits: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	opts := api.DefaultOptions()
+	query := r.URL.Query()
+	for key, dst := range map[string]any{
+		"temperature": &opts.Temperature,
+		"top_k":       &opts.TopK,
+		"top_p":       &opts.TopP,
+		"min_p":       &opts.MinP,
+		"seed":        &opts.Seed,
+	} {
+		value := query.Get(key)
+		if value == "" {
+			continue
+		}
+
+		var err error
+		switch dst := dst.(type) {
+		case *float32:
+			var f float64
+			f, err = strconv.ParseFloat(value, 32)
+			*dst = float32(f)
+		case *int:
+			*dst, err = strconv.Atoi(value)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid value for %s: %q", key, value), http.StatusBadRequest)
+			return
+		}
+	}
+
+	sampler := sample.NewSampler(opts.Temperature, opts.TopK, opts.TopP, opts.MinP, opts.Seed, nil)
+	token, err := sampler.Sample(logits)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// log probability of the token under the model's unmodified distribution
+	maxLogit := float32(math.Inf(-1))
+	for _, l := range logits {
+		maxLogit = max(maxLogit, l)
+	}
+
+	var sum float64
+	for _, l := range logits {
+		sum += math.Exp(float64(l - maxLogit))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&SampleResponse{
+		Token:   token,
+		Logprob: logits[token] - maxLogit - float32(math.Log(sum)),
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
 type multiLPath []string
 
 func (m *multiLPath) Set(value string) error {
@@ -820,6 +891,7 @@ func Execute(args []string) error {
 	_ = fs.Bool("no-mmap", false, "do not memory-map model (slower load but may reduce pageouts if not using mlock)")
 	tensorSplit := fs.String("tensor-split", "", "fraction of the model to offload to each GPU, comma-separated list of proportions")
 	multiUserCache := fs.Bool("multiuser-cache", false, "optimize input cache algorithm for multiple users")
+	sampleEndpoint := fs.Bool("sample-endpoint", false, "expose a debugging endpoint that samples from posted logits")
 
 	var lpaths multiLPath
 	fs.Var(&lpaths, "lora", "Path to lora layer file (can be specified multiple times)")
@@ -906,6 +978,10 @@ func Execute(args []string) error {
 	mux.HandleFunc("POST /completion", server.completion)
 	mux.HandleFunc("GET /health", server.health)
 
+	if *sampleEndpoint {
+		mux.HandleFunc("POST /sample", sampleLogits)
+	}
+
 	httpServer := http.Server{
 		Handler: mux,
 	}
@@ -0,0 +1,93 @@
+package ollamarunner
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ollama/ollama/sample"
+)
+
+func TestSampleLogits(t *testing.T) {
+	logits := []float32{0.5, 3, 1, 2.5, -1}
+
+	tests := []struct {
+		name    string
+		query   string
+		sampler sample.Sampler
+	}{
+		{
+			name:    "Greedy",
+			query:   "temperature=0",
+			sampler: sample.NewSampler(0, 40, 0.9, 0, -1, nil),
+		},
+		{
+			name:    "Seeded",
+			query:   "temperature=1.5&top_k=3&top_p=0.95&min_p=0.1&seed=7",
+			sampler: sample.NewSampler(1.5, 3, 0.95, 0.1, 7, nil),
+		},
+		{
+			name:    "TopK",
+			query:   "top_k=1&seed=1",
+			sampler: sample.NewSampler(0.8, 1, 0.9, 0, 1, nil),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			sampleLogits(w, httptest.NewRequest(http.MethodPost, "/sample?"+tt.query, strings.NewReader("[0.5, 3, 1, 2.5, -1]")))
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+			}
+
+			var resp SampleResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			want, err := tt.sampler.Sample(logits)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Token != want {
+				t.Errorf("token mismatch: want %d, got %d", want, resp.Token)
+			}
+
+			var sum float64
+			for _, l := range logits {
+				sum += math.Exp(float64(l))
+			}
+			wantLogprob := float64(logits[want]) - math.Log(sum)
+			if math.Abs(float64(resp.Logprob)-wantLogprob) > 1e-5 {
+				t.Errorf("logprob mismatch: want %f, got %f", wantLogprob, resp.Logprob)
+			}
+		})
+	}
+}
+
+func TestSampleLogitsInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		body  string
+	}{
+		{"InvalidOption", "top_k=many", "[1, 2]"},
+		{"InvalidBody", "", "{}"},
+		{"EmptyLogits", "", "[]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			sampleLogits(w, httptest.NewRequest(http.MethodPost, "/sample?"+tt.query, strings.NewReader(tt.body)))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("want status %d, got %d", http.StatusBadRequest, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package sample
+
+import (
+	"errors"
+	"math"
+	"math/rand/v2"
+)
+
+// aliasTable supports O(1) weighted draws from a fixed distribution after
+// O(n) setup using Vose's alias method. It is preferable to a cumulative sum
+// and binary search when many draws are taken from the same candidate set.
+type aliasTable struct {
+	tokens []token
+	prob   []float32
+	alias  []int
+}
+
+// newAliasTable builds an alias table from tokens whose values are
+// non-negative weights. The weights do not need to be normalized.
+func newAliasTable(tokens []token) (*aliasTable, error) {
+	n := len(tokens)
+	if n == 0 {
+		return nil, errors.New("sample: no tokens to build alias table")
+	}
+
+	var sum float64
+	for _, t := range tokens {
+		sum += float64(t.value)
+	}
+	if math.IsNaN(sum) || sum <= 0 {
+		return nil, errors.New("sample: alias table weights must sum to a positive value")
+	}
+
+	a := &aliasTable{
+		tokens: tokens,
+		prob:   make([]float32, n),
+		alias:  make([]int, n),
+	}
+
+	// scale each weight so that the average bucket holds exactly 1
+	scaled := make([]float64, n)
+	small := make([]int, 0, n)
+	large := make([]int, 0, n)
+	for i, t := range tokens {
+		scaled[i] = float64(t.value) * float64(n) / sum
+		if scaled[i] < 1 {
+			small = append(small, i)
+		} else {
+			large = append(large, i)
+		}
+	}
+
+	for len(small) > 0 && len(large) > 0 {
+		s := small[len(small)-1]
+		small = small[:len(small)-1]
+		l := large[len(large)-1]
+		large = large[:len(large)-1]
+
+		a.prob[s] = float32(scaled[s])
+		a.alias[s] = l
+
+		scaled[l] = scaled[l] + scaled[s] - 1
+		if scaled[l] < 1 {
+			small = append(small, l)
+		} else {
+			large = append(large, l)
+		}
+	}
+
+	// remaining buckets are full, up to floating point error
+	for _, i := range large {
+		a.prob[i] = 1
+		a.alias[i] = i
+	}
+	for _, i := range small {
+		a.prob[i] = 1
+		a.alias[i] = i
+	}
+
+	return a, nil
+}
+
+// sample draws a token from the table. If rng is nil the global source is used.
+func (a *aliasTable) sample(rng *rand.Rand) token {
+	var i int
+	var r float32
+	if rng != nil {
+		i = rng.IntN(len(a.prob))
+		r = rng.Float32()
+	} else {
+		i = rand.IntN(len(a.prob))
+		r = rand.Float32()
+	}
+
+	if r < a.prob[i] {
+		return a.tokens[i]
+	}
+	return a.tokens[a.alias[i]]
+}
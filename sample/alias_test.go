@@ -0,0 +1,92 @@
+package sample
+
+import (
+	"math"
+	"math/rand/v2"
+	"slices"
+	"testing"
+)
+
+func TestAliasTable(t *testing.T) {
+	weights := []float32{0.5, 0.25, 0.125, 0.0625, 0.0625, 0}
+	a, err := newAliasTable(toTokens(weights))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewPCG(42, 42^0x9E3779B9))
+	const draws = 200000
+	counts := make([]int, len(weights))
+	for range draws {
+		counts[a.sample(rng).id]++
+	}
+
+	for i, w := range weights {
+		got := float64(counts[i]) / draws
+		if math.Abs(got-float64(w)) > 0.01 {
+			t.Errorf("token %d: want frequency %f, got %f", i, w, got)
+		}
+	}
+
+	if counts[len(weights)-1] != 0 {
+		t.Errorf("zero weight token was drawn %d times", counts[len(weights)-1])
+	}
+}
+
+func TestAliasTableInvalid(t *testing.T) {
+	if _, err := newAliasTable(nil); err == nil {
+		t.Error("expected error for empty tokens")
+	}
+
+	if _, err := newAliasTable(toTokens([]float32{0, 0})); err == nil {
+		t.Error("expected error for zero weights")
+	}
+
+	if _, err := newAliasTable(toTokens([]float32{float32(math.NaN()), 1})); err == nil {
+		t.Error("expected error for NaN weights")
+	}
+}
+
+func BenchmarkAliasTable(b *testing.B) {
+	tokens := make([]token, 1<<16)
+	for i := range tokens {
+		tokens[i] = token{id: int32(i), value: rand.Float32()}
+	}
+	softmax(tokens)
+
+	rng := rand.New(rand.NewPCG(1, 2))
+
+	// both benchmarks measure the cost of a single draw once setup is done
+	b.Run("CDF", func(b *testing.B) {
+		cdf := slices.Clone(tokens)
+		var sum float32
+		for i := range cdf {
+			sum += cdf[i].value
+			cdf[i].value = sum
+		}
+
+		b.ResetTimer()
+		for b.Loop() {
+			r := rng.Float32() * sum
+			idx, _ := slices.BinarySearchFunc(cdf, r, func(token token, target float32) int {
+				if token.value < target {
+					return -1
+				}
+				return 1
+			})
+			_ = cdf[idx]
+		}
+	})
+
+	b.Run("Alias", func(b *testing.B) {
+		a, err := newAliasTable(tokens)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.ResetTimer()
+		for b.Loop() {
+			a.sample(rng)
+		}
+	})
+}
@@ -1,15 +1,29 @@
 package sample
 
 import (
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"log/slog"
 	"math"
 	"math/rand/v2"
 	"slices"
+	"time"
 
 	"github.com/ollama/ollama/llama"
 	"github.com/ollama/ollama/model"
 )
 
+// ErrEmptyLogits is returned when there are no logits to sample from
+var ErrEmptyLogits = errors.New("sample: no logits provided to sample")
+
+var errNaN = errors.New("sample: logits sum to NaN, check model output")
+
+// ErrNoCandidates is returned when constraints or the grammar mask every token
+var ErrNoCandidates = errors.New("sample: no candidate tokens remain")
+
 // token represents information about a single token during sampling
 type token struct {
 	id    int32   // The token's unique identifier
@@ -22,51 +36,234 @@ type Sampler struct {
 	topP        float32
 	minP        float32
 	temperature float32
+	tempLast    bool
+	clampedTopK bool
+	confidence  ConfidenceMetric
 	grammar     *GrammarSampler
+	constraints []Constraint
+}
+
+// Constraint restricts the candidate tokens based on the tokens sampled so far.
+// Constraints are applied to the full set of logits before any other transform.
+type Constraint interface {
+	// apply masks or adjusts the candidate tokens in place
+	apply([]token)
+
+	// accept records a sampled token
+	accept(int32)
+
+	// name identifies the constraint in the sampling chain
+	name() string
+}
+
+// sizedConstraint is implemented by constraints that only support logits of
+// a particular size
+type sizedConstraint interface {
+	checkSize(n int) error
 }
 
 func (s *Sampler) Sample(logits []float32) (int32, error) {
+	return s.sampleLogits(context.Background(), logits, nil)
+}
+
+// SampleContext samples like Sample but returns early with the context's error
+// once ctx is done. Cancellation is checked between constraints and between
+// stages of the sampling chain, so a single slow stage such as applying the
+// grammar is not cut short. The sampler's state is left unchanged when
+// sampling is cancelled.
+func (s *Sampler) SampleContext(ctx context.Context, logits []float32) (int32, error) {
+	return s.sampleLogits(ctx, logits, nil)
+}
+
+// Info describes a single sampling decision
+type Info struct {
+	Token   int32
+	Timings Timings
+
+	// Confidence is a score between 0 and 1 describing how decisive the
+	// distribution sampled from was, as measured by the sampler's
+	// ConfidenceMetric
+	Confidence float32
+
+	// Greedy is the most likely token of the distribution sampled from,
+	// which is what greedy sampling would have chosen
+	Greedy int32
+}
+
+// timings returns the timings to record to, or nil if info was not requested
+func (i *Info) timings() *Timings {
+	if i == nil {
+		return nil
+	}
+
+	return &i.Timings
+}
+
+// Timings breaks down the time spent making a sampling decision. Transforms
+// covers everything other than sorting and softmax, including constraints,
+// the grammar and the final draw.
+type Timings struct {
+	Total      time.Duration
+	Sort       time.Duration
+	Softmax    time.Duration
+	Transforms time.Duration
+}
+
+type stage int
+
+const (
+	stageSort stage = iota
+	stageSoftmax
+	stageTransforms
+)
+
+// begin starts timing a stage, it is a no-op if t is nil
+func (t *Timings) begin() time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+
+	return time.Now()
+}
+
+// lap adds the time since start to the given stage and returns the current time
+// for timing the next stage, it is a no-op if t is nil
+func (t *Timings) lap(s stage, start time.Time) time.Time {
+	if t == nil {
+		return start
+	}
+
+	now := time.Now()
+	switch s {
+	case stageSort:
+		t.Sort += now.Sub(start)
+	case stageSoftmax:
+		t.Softmax += now.Sub(start)
+	case stageTransforms:
+		t.Transforms += now.Sub(start)
+	}
+
+	return now
+}
+
+// SampleWithInfo samples a token like Sample and additionally reports
+// details about how the decision was made
+func (s *Sampler) SampleWithInfo(logits []float32) (Info, error) {
+	var info Info
+	start := time.Now()
+	t, err := s.sampleLogits(context.Background(), logits, &info)
+	if err != nil {
+		return Info{}, err
+	}
+
+	info.Token = t
+	info.Timings.Total = time.Since(start)
+	return info, nil
+}
+
+func (s *Sampler) sampleLogits(ctx context.Context, logits []float32, info *Info) (int32, error) {
 	if len(logits) == 0 {
-		return -1, errors.New("sample: no logits provided to sample")
+		return -1, ErrEmptyLogits
 	}
 
+	tm := info.timings()
+
+	start := tm.begin()
 	tokens := make([]token, len(logits))
-	for i := range logits {
-		tokens[i].id = int32(i)
-		tokens[i].value = logits[i]
+	if err := s.reset(ctx, tokens, logits); err != nil {
+		return -1, err
 	}
+	tm.lap(stageTransforms, start)
 
-	t, err := s.sample(tokens)
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+
+	t, err := s.sample(ctx, tokens, info)
 	if err != nil {
 		return -1, err
 	}
 
 	if s.grammar != nil {
+		start := tm.begin()
+
 		// optimization: first check if the max logit is accepted by the grammar
 		// if the max logit is rejected, apply the grammar to all logits (slower)
 		top := []token{t}
 		s.grammar.Apply(top)
-		if !math.IsInf(float64(top[0].value), -1) {
-			s.grammar.Accept(top[0].id)
-			return top[0].id, nil
+		if math.IsInf(float64(top[0].value), -1) {
+			// since .sample has side effects of modifying the tokens
+			// we need to reset them before applying the grammar and
+			// sampling again
+			if err := s.reset(ctx, tokens, logits); err != nil {
+				return -1, err
+			}
+			s.grammar.Apply(tokens)
+			if !hasCandidates(tokens) {
+				return -1, fmt.Errorf("%w after applying grammar", ErrNoCandidates)
+			}
+			tm.lap(stageTransforms, start)
+
+			if err := ctx.Err(); err != nil {
+				return -1, err
+			}
+
+			t, err = s.sample(ctx, tokens, info)
+			if err != nil {
+				return -1, err
+			}
+			start = tm.begin()
+		}
+		s.grammar.Accept(t.id)
+		tm.lap(stageTransforms, start)
+	}
+
+	start = tm.begin()
+	for _, c := range s.constraints {
+		c.accept(t.id)
+	}
+	tm.lap(stageTransforms, start)
+
+	return t.id, nil
+}
+
+// reset fills tokens from logits and applies the sampler's constraints,
+// stopping early if a constraint masks every token or ctx is done
+func (s *Sampler) reset(ctx context.Context, tokens []token, logits []float32) error {
+	for i := range logits {
+		tokens[i].id = int32(i)
+		tokens[i].value = logits[i]
+	}
+
+	for _, c := range s.constraints {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
 
-		// since .sample has side effects of modifying the tokens
-		// we need to reset them before applying the grammar and
-		// sampling again
-		for i := range logits {
-			tokens[i].id = int32(i)
-			tokens[i].value = logits[i]
+		if sc, ok := c.(sizedConstraint); ok {
+			if err := sc.checkSize(len(logits)); err != nil {
+				return err
+			}
 		}
-		s.grammar.Apply(tokens)
-		t, err = s.sample(tokens)
-		if err != nil {
-			return -1, err
+
+		c.apply(tokens)
+		if !hasCandidates(tokens) {
+			return fmt.Errorf("%w after applying %s", ErrNoCandidates, c.name())
 		}
-		s.grammar.Accept(t.id)
 	}
 
-	return t.id, nil
+	return nil
+}
+
+// hasCandidates reports whether any token has not been masked
+func hasCandidates(tokens []token) bool {
+	for _, t := range tokens {
+		if !math.IsInf(float64(t.value), -1) {
+			return true
+		}
+	}
+
+	return false
 }
 
 // greedy returns the highest probability token from the tokens
@@ -83,28 +280,39 @@ func greedy(tokens []token) token {
 
 // sample returns the highest probability token from the tokens
 // given sampler parameters. It also has side effects of modifying the tokens
-func (s *Sampler) sample(tokens []token) (token, error) {
+func (s *Sampler) sample(ctx context.Context, tokens []token, info *Info) (token, error) {
+	tm := info.timings()
 	if s.temperature == 0 {
-		return greedy(tokens), nil
+		start := tm.begin()
+		t := greedy(tokens)
+		tm.lap(stageTransforms, start)
+
+		if info != nil {
+			probs := slices.Clone(tokens)
+			softmax(probs)
+			info.Confidence = confidence(probs, s.confidence)
+			info.Greedy = t.id
+		}
+		return t, nil
 	}
 
-	// topK also sorts the tokens in descending order of logits
-	tokens = topK(tokens, s.topK)
+	tokens, err := s.distribution(ctx, tokens, s.topK, tm)
+	if err != nil {
+		return token{}, err
+	}
 
-	// scale and normalize the tokens in place
-	temperature(tokens, s.temperature)
-	softmax(tokens)
+	start := tm.begin()
+	defer tm.lap(stageTransforms, start)
 
-	tokens = topP(tokens, s.topP)
-	tokens = minP(tokens, s.minP)
+	if info != nil {
+		info.Confidence = confidence(tokens, s.confidence)
 
-	var r float32
-	if s.rng != nil {
-		r = s.rng.Float32()
-	} else {
-		r = rand.Float32()
+		// tokens are sorted in descending order of probability
+		info.Greedy = tokens[0].id
 	}
 
+	r := s.random()
+
 	// Calculate cumulative sum of probabilities
 	var sum float32
 	for i := range tokens {
@@ -121,13 +329,260 @@ func (s *Sampler) sample(tokens []token) (token, error) {
 	})
 
 	if math.IsNaN(float64(sum)) {
-		return token{}, errors.New("sample: logits sum to NaN, check model output")
+		return token{}, errNaN
 	}
 	return tokens[idx], nil
 }
 
+// distribution truncates to the k most likely tokens and scales the tokens
+// according to the sampler parameters, returning the remaining tokens sorted
+// in descending order of probability. It also has side effects of modifying
+// the tokens
+func (s *Sampler) distribution(ctx context.Context, tokens []token, k int, tm *Timings) ([]token, error) {
+	start := tm.begin()
+
+	if k > len(tokens) {
+		if !s.clampedTopK {
+			slog.Debug("top_k exceeds vocabulary size, keeping all tokens", "top_k", k, "vocab_size", len(tokens))
+			s.clampedTopK = true
+		}
+		k = len(tokens)
+	}
+
+	// topK also sorts the tokens in descending order of logits
+	tokens = topK(tokens, k)
+	start = tm.lap(stageSort, start)
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if s.tempLast {
+		// truncate on the unscaled distribution, then rescale the survivors
+		softmax(tokens)
+		start = tm.lap(stageSoftmax, start)
+
+		tokens = topP(tokens, s.topP)
+		tokens = minP(tokens, s.minP)
+
+		logProbs(tokens)
+		temperature(tokens, s.temperature)
+		start = tm.lap(stageTransforms, start)
+
+		softmax(tokens)
+		tm.lap(stageSoftmax, start)
+	} else {
+		// scale and normalize the tokens in place
+		temperature(tokens, s.temperature)
+		start = tm.lap(stageTransforms, start)
+
+		softmax(tokens)
+		start = tm.lap(stageSoftmax, start)
+
+		tokens = topP(tokens, s.topP)
+		tokens = minP(tokens, s.minP)
+		tm.lap(stageTransforms, start)
+	}
+
+	return tokens, nil
+}
+
+// SampleN draws n distinct tokens without replacement from the distribution
+// the sampler would sample from, renormalizing after each draw. If fewer than
+// n tokens remain after truncation, all of them are returned. Tokens are not
+// recorded by the sampler's grammar or constraints since the caller decides
+// which of them to use.
+func (s *Sampler) SampleN(logits []float32, n int) ([]int32, error) {
+	if len(logits) == 0 {
+		return nil, ErrEmptyLogits
+	}
+
+	if n < 1 {
+		return nil, fmt.Errorf("sample: number of samples must be at least 1, got %d", n)
+	}
+
+	tokens := make([]token, len(logits))
+	if err := s.reset(context.Background(), tokens, logits); err != nil {
+		return nil, err
+	}
+
+	if s.grammar != nil {
+		s.grammar.Apply(tokens)
+		if !hasCandidates(tokens) {
+			return nil, fmt.Errorf("%w after applying grammar", ErrNoCandidates)
+		}
+	}
+
+	if s.temperature == 0 {
+		tokens = topK(tokens, n)
+		ids := make([]int32, 0, n)
+		for _, t := range tokens {
+			if math.IsInf(float64(t.value), -1) {
+				break
+			}
+			ids = append(ids, t.id)
+		}
+		return ids, nil
+	}
+
+	tokens, err := s.distribution(context.Background(), tokens, s.topK, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// tokens are sorted so any masked tokens are at the end
+	var sum float32
+	for i, t := range tokens {
+		if t.value <= 0 {
+			tokens = tokens[:i]
+			break
+		}
+		sum += t.value
+	}
+	if math.IsNaN(float64(sum)) {
+		return nil, errNaN
+	}
+
+	ids := make([]int32, 0, min(n, len(tokens)))
+	if len(tokens) == 0 {
+		return ids, nil
+	}
+
+	// drawing from the full distribution and rejecting tokens that were
+	// already drawn is equivalent to drawing from the renormalized remainder,
+	// so a single alias table serves every draw until rejections become
+	// likely, at which point it is rebuilt from the remaining tokens
+	table, err := newAliasTable(tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	drawn := make(map[int32]bool, n)
+	candidates := len(tokens)
+	total, remaining := sum, sum
+	for len(ids) < n && len(ids) < candidates {
+		if remaining < total/2 {
+			tokens = slices.DeleteFunc(tokens, func(t token) bool { return drawn[t.id] })
+			if table, err = newAliasTable(tokens); err != nil {
+				return nil, err
+			}
+			total = remaining
+		}
+
+		t := table.sample(s.rng)
+		if drawn[t.id] {
+			continue
+		}
+
+		drawn[t.id] = true
+		ids = append(ids, t.id)
+		remaining -= t.value
+	}
+
+	return ids, nil
+}
+
+// random returns a random number in [0, 1) from the sampler's source
+func (s *Sampler) random() float32 {
+	if s.rng != nil {
+		return s.rng.Float32()
+	}
+
+	return rand.Float32()
+}
+
+// FilteredLogits applies the sampler's constraints, grammar and truncation to
+// the logits and returns the ids of the remaining tokens together with their
+// logits scaled by temperature, for callers that perform the final draw
+// themselves. The tokens are sorted in descending order of logits. With a
+// temperature of 0 only the most likely token remains and its logit is
+// unscaled.
+func (s *Sampler) FilteredLogits(logits []float32) ([]int32, []float32, error) {
+	if len(logits) == 0 {
+		return nil, nil, ErrEmptyLogits
+	}
+
+	tokens := make([]token, len(logits))
+	if err := s.reset(context.Background(), tokens, logits); err != nil {
+		return nil, nil, err
+	}
+
+	if s.grammar != nil {
+		s.grammar.Apply(tokens)
+		if !hasCandidates(tokens) {
+			return nil, nil, fmt.Errorf("%w after applying grammar", ErrNoCandidates)
+		}
+	}
+
+	if s.temperature == 0 {
+		t := greedy(tokens)
+		return []int32{t.id}, []float32{t.value}, nil
+	}
+
+	// token ids match their positions so the adjusted logits can be found
+	// after the tokens are reordered
+	adjusted := make([]float32, len(tokens))
+	for _, t := range tokens {
+		adjusted[t.id] = t.value
+	}
+
+	tokens, err := s.distribution(context.Background(), tokens, s.topK, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ids := make([]int32, 0, len(tokens))
+	values := make([]float32, 0, len(tokens))
+	for _, t := range tokens {
+		if t.value <= 0 {
+			break
+		}
+
+		ids = append(ids, t.id)
+		values = append(values, adjusted[t.id]/max(s.temperature, 1e-7))
+	}
+
+	return ids, values, nil
+}
+
+// TimeBudget samples with an inner sampler, falling back to a cheaper sampler
+// such as greedy if the inner sampler does not finish within the budget.
+//
+// The budget is checked between constraints and between stages of the inner
+// sampler's chain, so a single slow constraint or grammar application runs to
+// completion before the fallback starts. The fallback is used with the inner
+// sampler's grammar and constraints in place of its own, which keeps the
+// fallback's token valid and the inner sampler's state in sync with the
+// generated text.
+type TimeBudget struct {
+	budget   time.Duration
+	inner    *Sampler
+	fallback *Sampler
+}
+
+func NewTimeBudget(budget time.Duration, inner, fallback *Sampler) *TimeBudget {
+	return &TimeBudget{budget: budget, inner: inner, fallback: fallback}
+}
+
+func (b *TimeBudget) Sample(logits []float32) (int32, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), b.budget)
+	defer cancel()
+
+	t, err := b.inner.SampleContext(ctx, logits)
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.Debug("sampling exceeded time budget, using fallback", "budget", b.budget)
+
+		fallback := *b.fallback
+		fallback.grammar = b.inner.grammar
+		fallback.constraints = b.inner.constraints
+		return fallback.Sample(logits)
+	}
+
+	return t, err
+}
+
 // TODO(parthsareen): update sampler interface to use json unmarshal https://github.com/ollama/ollama/issues/9278
-func NewSampler(temperature float32, topK int, topP float32, minP float32, seed int, grammar *GrammarSampler) Sampler {
+func NewSampler(temperature float32, topK int, topP float32, minP float32, seed int, grammar *GrammarSampler, constraints ...Constraint) Sampler {
 	var rng *rand.Rand
 	if seed != -1 {
 		// PCG requires two parameters: sequence and stream
@@ -161,9 +616,97 @@ func NewSampler(temperature float32, topK int, topP float32, minP float32, seed
 		minP:        minP,
 		temperature: temperature,
 		grammar:     grammar,
+		constraints: constraints,
+	}
+}
+
+// TemperatureOrder controls where temperature is applied in the sampling chain
+type TemperatureOrder int
+
+const (
+	// TemperatureFirst scales the logits before truncating with top-p and min-p
+	TemperatureFirst TemperatureOrder = iota
+
+	// TemperatureLast truncates the unscaled distribution with top-p and min-p
+	// and scales the remaining tokens, like llama.cpp's temp_last option
+	TemperatureLast
+)
+
+// SetTemperatureOrder changes where temperature is applied in the sampling chain
+func (s *Sampler) SetTemperatureOrder(order TemperatureOrder) {
+	s.tempLast = order == TemperatureLast
+}
+
+// cryptoSource is a rand.Source backed by crypto/rand
+type cryptoSource struct{}
+
+func (cryptoSource) Uint64() uint64 {
+	var b [8]byte
+	crand.Read(b[:])
+	return binary.LittleEndian.Uint64(b[:])
+}
+
+// UseCryptoRand sources randomness from crypto/rand instead of the seeded
+// generator. Samples are unpredictable and cannot be reproduced with a seed.
+func (s *Sampler) UseCryptoRand() {
+	s.rng = rand.New(cryptoSource{})
+}
+
+// ConfidenceMetric selects how Info.Confidence is calculated
+type ConfidenceMetric int
+
+const (
+	// ConfidenceMargin is the difference between the probabilities of the
+	// two most likely tokens
+	ConfidenceMargin ConfidenceMetric = iota
+
+	// ConfidenceEntropy is one minus the entropy of the distribution
+	// normalized by the maximum entropy for the number of tokens
+	ConfidenceEntropy
+)
+
+// SetConfidenceMetric changes how SampleWithInfo calculates confidence
+func (s *Sampler) SetConfidenceMetric(metric ConfidenceMetric) {
+	s.confidence = metric
+}
+
+// Describe returns the names of the transforms applied by the sampler in the
+// order they are applied, starting with its constraints and grammar
+func (s *Sampler) Describe() []string {
+	var chain []string
+	for _, c := range s.constraints {
+		chain = append(chain, c.name())
+	}
+
+	if s.grammar != nil {
+		chain = append(chain, "grammar")
+	}
+
+	switch {
+	case s.temperature == 0:
+		return append(chain, "greedy")
+	case s.tempLast:
+		return append(chain, "top_k", "top_p", "min_p", "temperature")
+	default:
+		return append(chain, "top_k", "temperature", "top_p", "min_p")
 	}
 }
 
+// NewLlamaCppSampler returns a sampler using llama.cpp's default sampling
+// parameters and chain order, where penalties are applied first and
+// temperature is applied after truncation. The penalties use llama.cpp's
+// defaults of the last 64 tokens and a repeat penalty of 1, which leaves the
+// logits unchanged. llama.cpp's tail-free and typical sampling are disabled
+// by default and are therefore omitted from the chain.
+func NewLlamaCppSampler(seed int, grammar *GrammarSampler) Sampler {
+	// the defaults are always valid
+	penalties, _ := NewPenalties(64, 1, 0, 0)
+
+	s := NewSampler(0.8, 40, 0.95, 0.05, seed, grammar, penalties)
+	s.SetTemperatureOrder(TemperatureLast)
+	return s
+}
+
 type GrammarSampler struct {
 	grammar *llama.Grammar
 }
@@ -184,6 +727,17 @@ func NewGrammarSampler(model model.TextProcessor, grammarStr string) (*GrammarSa
 	return &GrammarSampler{grammar: grammar}, nil
 }
 
+// NewSchemaSampler creates a grammar sampler that constrains output to JSON
+// matching the provided JSON schema
+func NewSchemaSampler(model model.TextProcessor, schema []byte) (*GrammarSampler, error) {
+	grammar := llama.SchemaToGrammar(schema)
+	if grammar == nil {
+		return nil, errors.New("sample: invalid JSON schema")
+	}
+
+	return NewGrammarSampler(model, string(grammar))
+}
+
 func (g *GrammarSampler) Apply(tokens []token) {
 	tds := make([]llama.TokenData, len(tokens))
 	for i, token := range tokens {
@@ -1,12 +1,17 @@
 package sample
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"math"
 	"math/rand/v2"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/ollama/ollama/model"
 )
@@ -173,3 +178,697 @@ func BenchmarkSample(b *testing.B) {
 		})
 	}
 }
+
+func TestLlamaCppSampler(t *testing.T) {
+	sampler := NewLlamaCppSampler(42, nil)
+
+	// llama.cpp's default chain: penalties, top_k, typical_p, top_p, min_p, temperature
+	// with typical_p disabled by default
+	want := []string{"penalties", "top_k", "top_p", "min_p", "temperature"}
+	if got := sampler.Describe(); !slices.Equal(want, got) {
+		t.Errorf("chain mismatch: want %v, got %v", want, got)
+	}
+
+	penalties := sampler.constraints[0].(*Penalties)
+	if len(penalties.window) != 64 || penalties.repeat != 1 || penalties.frequency != 0 || penalties.presence != 0 {
+		t.Errorf("unexpected penalty defaults: %+v", penalties)
+	}
+
+	if sampler.topK != 40 || sampler.topP != 0.95 || sampler.minP != 0.05 || sampler.temperature != 0.8 {
+		t.Errorf("unexpected defaults: %+v", sampler)
+	}
+
+	// min_p is applied before temperature so the low probability tokens are
+	// removed based on the unscaled distribution
+	logits := []float32{10, 9, 0, -10}
+	for range 100 {
+		got, err := sampler.Sample(logits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != 0 && got != 1 {
+			t.Fatalf("sampled token %d should have been truncated", got)
+		}
+	}
+
+	greedy := NewSampler(0, 0, 0, 0, 0, nil)
+	if got := greedy.Describe(); !slices.Equal([]string{"greedy"}, got) {
+		t.Errorf("chain mismatch: want [greedy], got %v", got)
+	}
+
+	// constraints are applied before the built in transforms
+	constrained := NewSampler(1, 0, 1, 0, 0, nil, NewBannedTokens([]int32{1}), NewFlatTail(1, 1))
+	want = []string{"banned_tokens", "flat_tail", "top_k", "temperature", "top_p", "min_p"}
+	if got := constrained.Describe(); !slices.Equal(want, got) {
+		t.Errorf("chain mismatch: want %v, got %v", want, got)
+	}
+}
+
+func TestSampleWithInfoTimings(t *testing.T) {
+	logits := make([]float32, 1<<16)
+	for i := range logits {
+		logits[i] = rand.Float32()
+	}
+
+	for _, tempLast := range []bool{false, true} {
+		sampler := NewSampler(0.8, 40, 0.9, 0.05, 42, nil)
+		if tempLast {
+			sampler.SetTemperatureOrder(TemperatureLast)
+		}
+
+		info, err := sampler.SampleWithInfo(logits)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tm := info.Timings
+		if tm.Sort < 0 || tm.Softmax < 0 || tm.Transforms < 0 {
+			t.Fatalf("negative timings: %+v", tm)
+		}
+
+		sum := tm.Sort + tm.Softmax + tm.Transforms
+		if sum > tm.Total || sum < tm.Total/2 {
+			t.Errorf("component timings %v do not add up to total %v", sum, tm.Total)
+		}
+
+		if tm.Sort == 0 || tm.Softmax == 0 {
+			t.Errorf("expected sort and softmax to be timed: %+v", tm)
+		}
+	}
+}
+
+func TestSampleEmptyLogits(t *testing.T) {
+	samplers := map[string]Sampler{
+		"Greedy":   NewSampler(0, 0, 0, 0, 0, nil),
+		"Weighted": NewSampler(0.8, 40, 0.9, 0.05, 0, nil),
+	}
+
+	for name, sampler := range samplers {
+		t.Run(name, func(t *testing.T) {
+			for _, logits := range [][]float32{nil, {}} {
+				got, err := sampler.Sample(logits)
+				if !errors.Is(err, ErrEmptyLogits) {
+					t.Errorf("want ErrEmptyLogits, got %v", err)
+				}
+				if got != -1 {
+					t.Errorf("want token -1, got %d", got)
+				}
+
+				if _, err := sampler.SampleWithInfo(logits); !errors.Is(err, ErrEmptyLogits) {
+					t.Errorf("want ErrEmptyLogits, got %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestTemperatureOrder(t *testing.T) {
+	// with the unscaled distribution, min-p removes tokens 2 and 3 but once
+	// the high temperature flattens the distribution all tokens survive
+	logits := []float32{3, 2, 0, -1}
+
+	first := NewSampler(4, 0, 1, 0.2, 42, nil)
+	last := NewSampler(4, 0, 1, 0.2, 42, nil)
+	last.SetTemperatureOrder(TemperatureLast)
+
+	if got := first.Describe(); !slices.Equal([]string{"top_k", "temperature", "top_p", "min_p"}, got) {
+		t.Errorf("temperature first chain: got %v", got)
+	}
+	if got := last.Describe(); !slices.Equal([]string{"top_k", "top_p", "min_p", "temperature"}, got) {
+		t.Errorf("temperature last chain: got %v", got)
+	}
+
+	var firstTail, lastTail int
+	for range 1000 {
+		got, err := first.Sample(logits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got > 1 {
+			firstTail++
+		}
+
+		got, err = last.Sample(logits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got > 1 {
+			lastTail++
+		}
+	}
+
+	if firstTail == 0 {
+		t.Error("temperature first should sample tokens min-p removes from the unscaled distribution")
+	}
+	if lastTail != 0 {
+		t.Errorf("temperature last sampled truncated tokens %d times", lastTail)
+	}
+}
+
+func TestSampleWithInfoConfidence(t *testing.T) {
+	peaked := []float32{10, 0, 0, 0, 0, 0, 0, 0}
+	flat := []float32{1, 1, 1, 1, 1, 1, 1, 1}
+
+	for _, metric := range []ConfidenceMetric{ConfidenceMargin, ConfidenceEntropy} {
+		for _, temp := range []float32{0, 1} {
+			sampler := NewSampler(temp, 0, 1, 0, 42, nil)
+			sampler.SetConfidenceMetric(metric)
+
+			info, err := sampler.SampleWithInfo(peaked)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Confidence < 0.9 || info.Confidence > 1 {
+				t.Errorf("metric %d temperature %v: peaked confidence should be high, got %f", metric, temp, info.Confidence)
+			}
+
+			info, err = sampler.SampleWithInfo(flat)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Confidence < 0 || info.Confidence > 0.01 {
+				t.Errorf("metric %d temperature %v: flat confidence should be low, got %f", metric, temp, info.Confidence)
+			}
+		}
+	}
+
+	// confidence is measured on the distribution after truncation
+	sampler := NewSampler(1, 1, 1, 0, 42, nil)
+	info, err := sampler.SampleWithInfo(flat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Confidence != 1 {
+		t.Errorf("a single candidate should have confidence 1, got %f", info.Confidence)
+	}
+}
+
+// slowConstraint delays sampling without changing the tokens
+type slowConstraint struct {
+	delay    time.Duration
+	applied  int
+	accepted []int32
+}
+
+func (c *slowConstraint) apply([]token) {
+	c.applied++
+	time.Sleep(c.delay)
+}
+
+func (c *slowConstraint) accept(id int32) { c.accepted = append(c.accepted, id) }
+
+func (c *slowConstraint) name() string { return "slow" }
+
+func TestTimeBudget(t *testing.T) {
+	logits := []float32{1, 5, 2, 3}
+
+	unused := &slowConstraint{}
+	fallback := NewSampler(0, 0, 0, 0, 0, nil, unused)
+
+	slow := &slowConstraint{delay: 20 * time.Millisecond}
+	after := &slowConstraint{}
+	inner := NewSampler(0, 0, 0, 0, 0, nil, slow, after)
+
+	budget := NewTimeBudget(5*time.Millisecond, &inner, &fallback)
+	got, err := budget.Sample(logits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 1 {
+		t.Errorf("want token 1, got %d", got)
+	}
+
+	// the inner sampler stops after the slow constraint and the fallback
+	// applies the constraints again
+	if slow.applied != 2 || after.applied != 1 {
+		t.Errorf("inner sampler should stop once over budget, applied %d and %d times", slow.applied, after.applied)
+	}
+
+	// the inner sampler's constraints record the fallback's token
+	if !slices.Equal(slow.accepted, []int32{1}) || !slices.Equal(after.accepted, []int32{1}) {
+		t.Errorf("inner constraints should record the fallback token, got %v and %v", slow.accepted, after.accepted)
+	}
+	if unused.applied != 0 || len(unused.accepted) != 0 {
+		t.Errorf("fallback's own constraints should not be used, got %v", unused.accepted)
+	}
+
+	fast := &slowConstraint{}
+	inner = NewSampler(0, 0, 0, 0, 0, nil, fast)
+	budget = NewTimeBudget(time.Second, &inner, &fallback)
+	got, err = budget.Sample(logits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 1 || !slices.Equal(fast.accepted, []int32{1}) {
+		t.Errorf("expected inner sampler to pick token 1, got %d", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := inner.SampleContext(ctx, logits); !errors.Is(err, context.Canceled) {
+		t.Errorf("want context.Canceled, got %v", err)
+	}
+	if len(fast.accepted) != 1 {
+		t.Errorf("cancelled sampler should not record tokens, got %v", fast.accepted)
+	}
+}
+
+func TestTimeBudgetGrammar(t *testing.T) {
+	tokenizer := modelHelper(t)
+
+	grammar, err := NewGrammarSampler(tokenizer, `root ::= "{"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer grammar.Free()
+
+	vocab := tokenizer.Vocabulary()
+	open, bracket := vocab.Encode("{"), vocab.Encode("[")
+
+	logits := make([]float32, len(vocab.Values))
+	logits[bracket] = 10
+	logits[open] = 1
+
+	inner := NewSampler(0, 0, 0, 0, 0, grammar, &slowConstraint{delay: 20 * time.Millisecond})
+	fallback := NewSampler(0, 0, 0, 0, 0, nil)
+
+	// the fallback uses the inner sampler's grammar rather than picking the
+	// most likely token
+	got, err := NewTimeBudget(5*time.Millisecond, &inner, &fallback).Sample(logits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != open {
+		t.Errorf("want grammar token %d, got %d", open, got)
+	}
+}
+
+func TestTopKMinP(t *testing.T) {
+	// top-k keeps the first three tokens, which have probabilities relative to
+	// the most likely token of 1, e^-0.5 ~ 0.61 and e^-1 ~ 0.37, so min-p of 0.5
+	// keeps only the first two
+	logits := []float32{4, 1, 4.5, 0, 5}
+	want := []int32{4, 2}
+
+	tokens := topK(toTokens(logits), 3)
+	softmax(tokens)
+	tokens = minP(tokens, 0.5)
+	var got []int32
+	for _, tok := range tokens {
+		got = append(got, tok.id)
+	}
+	if !slices.Equal(want, got) {
+		t.Errorf("kept tokens: want %v, got %v", want, got)
+	}
+
+	for _, order := range []TemperatureOrder{TemperatureFirst, TemperatureLast} {
+		sampler := NewSampler(1, 3, 1, 0.5, 42, nil)
+		sampler.SetTemperatureOrder(order)
+
+		seen := make(map[int32]int)
+		for range 1000 {
+			id, err := sampler.Sample(logits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seen[id]++
+		}
+
+		if len(seen) != len(want) || seen[want[0]] == 0 || seen[want[1]] == 0 {
+			t.Errorf("order %d: want only tokens %v to be sampled, got %v", order, want, seen)
+		}
+	}
+}
+
+func TestCryptoRand(t *testing.T) {
+	logits := make([]float32, 32)
+
+	sequence := func() []int32 {
+		// a fixed seed is overridden by crypto/rand
+		sampler := NewSampler(1, 0, 1, 0, 42, nil)
+		sampler.UseCryptoRand()
+
+		ids := make([]int32, 64)
+		for i := range ids {
+			id, err := sampler.Sample(logits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids[i] = id
+		}
+		return ids
+	}
+
+	if a, b := sequence(), sequence(); slices.Equal(a, b) {
+		t.Errorf("crypto/rand samplers produced identical sequences: %v", a)
+	}
+}
+
+func TestNoCandidates(t *testing.T) {
+	// nothing may follow token 0
+	transitions := NewTransitions(map[int32][]int32{0: {}})
+	later := &slowConstraint{}
+	sampler := NewSampler(0, 0, 0, 0, 0, nil, transitions, later)
+
+	logits := []float32{3, 1, 2}
+	if _, err := sampler.Sample(logits); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := sampler.Sample(logits)
+	if !errors.Is(err, ErrNoCandidates) {
+		t.Fatalf("want ErrNoCandidates, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "transitions") {
+		t.Errorf("error should name the constraint that masked every token: %v", err)
+	}
+	if later.applied != 1 {
+		t.Errorf("constraints after an empty set should be skipped, applied %d times", later.applied)
+	}
+}
+
+func TestSampleN(t *testing.T) {
+	logits := []float32{2, 1, 0, -1, -2}
+	probs := toTokens(logits)
+	softmax(probs)
+
+	sampler := NewSampler(1, 0, 1, 0, 42, nil)
+
+	const runs = 20000
+	firsts := make([]int, len(logits))
+	seconds := make([]int, len(logits))
+	for range runs {
+		ids, err := sampler.SampleN(logits, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(ids) != 3 {
+			t.Fatalf("want 3 tokens, got %v", ids)
+		}
+
+		seen := make(map[int32]bool)
+		for _, id := range ids {
+			if seen[id] {
+				t.Fatalf("tokens are not distinct: %v", ids)
+			}
+			seen[id] = true
+		}
+
+		firsts[ids[0]]++
+		seconds[ids[1]]++
+	}
+
+	// the first draw follows the distribution
+	for i, p := range probs {
+		got := float64(firsts[i]) / runs
+		if math.Abs(got-float64(p.value)) > 0.02 {
+			t.Errorf("token %d: want frequency %f, got %f", i, p.value, got)
+		}
+	}
+
+	// the second draw follows the distribution renormalized without the first
+	for j, q := range probs {
+		var want float64
+		for i, p := range probs {
+			if i != j {
+				want += float64(p.value) * float64(q.value) / (1 - float64(p.value))
+			}
+		}
+
+		got := float64(seconds[j]) / runs
+		if math.Abs(got-want) > 0.02 {
+			t.Errorf("token %d: want second draw frequency %f, got %f", j, want, got)
+		}
+	}
+
+	// only the truncated set can be returned
+	sampler = NewSampler(1, 2, 1, 0, 42, nil)
+	ids, err := sampler.SampleN(logits, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(ids)
+	if !slices.Equal(ids, []int32{0, 1}) {
+		t.Errorf("want all of the top 2 tokens, got %v", ids)
+	}
+
+	greedy := NewSampler(0, 0, 0, 0, 0, nil)
+	ids, err = greedy.SampleN([]float32{1, 3, 2}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(ids, []int32{1, 2}) {
+		t.Errorf("greedy: want [1 2], got %v", ids)
+	}
+
+	if _, err := sampler.SampleN(logits, 0); err == nil {
+		t.Error("expected error for n of 0")
+	}
+	if _, err := sampler.SampleN(nil, 1); !errors.Is(err, ErrEmptyLogits) {
+		t.Errorf("want ErrEmptyLogits, got %v", err)
+	}
+}
+
+func TestTopKExceedsVocabulary(t *testing.T) {
+	logits := []float32{1, 3, 2}
+
+	sampler := NewSampler(1, 100, 1, 0, 42, nil)
+	seen := make(map[int32]bool)
+	for range 1000 {
+		id, err := sampler.Sample(logits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[id] = true
+	}
+	if len(seen) != len(logits) {
+		t.Errorf("all tokens should be kept, sampled %v", seen)
+	}
+	if !sampler.clampedTopK {
+		t.Error("top_k should be clamped to the vocabulary size")
+	}
+
+	ids, err := sampler.SampleN(logits, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != len(logits) {
+		t.Errorf("all tokens should be kept, got %v", ids)
+	}
+
+	tokens := topK(toTokens(logits), 100)
+	if len(tokens) != len(logits) {
+		t.Errorf("topK(100): want %d tokens, got %d", len(logits), len(tokens))
+	}
+}
+
+func TestSampleWithInfoGreedy(t *testing.T) {
+	logits := []float32{1, 2, 2.5, 0}
+
+	sampler := NewSampler(1, 0, 1, 0, 42, nil)
+	var differs bool
+	for range 100 {
+		info, err := sampler.SampleWithInfo(logits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Greedy != 2 {
+			t.Fatalf("want greedy token 2, got %d", info.Greedy)
+		}
+		if info.Token != info.Greedy {
+			differs = true
+		}
+	}
+	if !differs {
+		t.Error("sampled token should sometimes differ from the greedy token")
+	}
+
+	// the greedy token is taken from the distribution after constraints
+	bias := NewBiasVector([]float32{5, 0, 0, 0})
+	for _, temp := range []float32{0, 1} {
+		sampler = NewSampler(temp, 0, 1, 0, 42, nil, bias)
+		info, err := sampler.SampleWithInfo(logits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Greedy != 0 {
+			t.Errorf("temperature %v: want greedy token 0, got %d", temp, info.Greedy)
+		}
+	}
+}
+
+func TestFilteredLogits(t *testing.T) {
+	logits := []float32{1, 4, 3, 2, -10}
+
+	for _, order := range []TemperatureOrder{TemperatureFirst, TemperatureLast} {
+		sampler := NewSampler(0.5, 3, 1, 0.1, 42, nil)
+		sampler.SetTemperatureOrder(order)
+
+		ids, values, err := sampler.FilteredLogits(logits)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// token 3 survives top-k but min-p removes it once temperature sharpens
+		// the distribution, while the unscaled distribution keeps it
+		want := []int32{1, 2, 3}
+		if order == TemperatureFirst {
+			want = want[:2]
+		}
+		if !slices.Equal(want, ids) {
+			t.Errorf("order %d: want ids %v, got %v", order, want, ids)
+		}
+
+		for i, id := range ids {
+			if values[i] != logits[id]/0.5 {
+				t.Errorf("order %d: token %d: want logit %f, got %f", order, id, logits[id]/0.5, values[i])
+			}
+		}
+	}
+
+	greedy := NewSampler(0, 0, 0, 0, 0, nil)
+	ids, values, err := greedy.FilteredLogits(logits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(ids, []int32{1}) || !slices.Equal(values, []float32{4}) {
+		t.Errorf("greedy: got ids %v logits %v", ids, values)
+	}
+
+	if _, _, err := greedy.FilteredLogits(nil); !errors.Is(err, ErrEmptyLogits) {
+		t.Errorf("want ErrEmptyLogits, got %v", err)
+	}
+}
+
+// TestLlamaCppReference checks the sampler against reference outputs from
+// llama.cpp's sampler chain. The random number generators differ so rather
+// than comparing sampled tokens, the set of tokens sampled from and their
+// probabilities are compared, along with the token chosen by greedy sampling.
+// See llama/sampling_fixtures_test.go to regenerate or add fixtures.
+func TestLlamaCppReference(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "llama.cpp.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var fixtures []struct {
+		Name        string    `json:"name"`
+		Logits      []float32 `json:"logits"`
+		TopK        int       `json:"top_k"`
+		TopP        float32   `json:"top_p"`
+		MinP        float32   `json:"min_p"`
+		Temperature float32   `json:"temperature"`
+		Tokens      []int32   `json:"tokens"`
+		Probs       []float32 `json:"probs"`
+	}
+	if err := json.NewDecoder(f).Decode(&fixtures); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range fixtures {
+		t.Run(tt.Name, func(t *testing.T) {
+			sampler := NewSampler(tt.Temperature, tt.TopK, tt.TopP, tt.MinP, 0, nil)
+			sampler.SetTemperatureOrder(TemperatureLast)
+
+			if tt.Temperature == 0 {
+				got, err := sampler.Sample(tt.Logits)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != tt.Tokens[0] {
+					t.Errorf("want token %d, got %d", tt.Tokens[0], got)
+				}
+				return
+			}
+
+			ids, logits, err := sampler.FilteredLogits(tt.Logits)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// llama.cpp does not always sort the remaining tokens
+			if !slices.Equal(slices.Sorted(slices.Values(tt.Tokens)), slices.Sorted(slices.Values(ids))) {
+				t.Fatalf("want tokens %v, got %v", tt.Tokens, ids)
+			}
+
+			want := make(map[int32]float32)
+			for i, id := range tt.Tokens {
+				want[id] = tt.Probs[i]
+			}
+
+			probs := toTokens(logits)
+			softmax(probs)
+			for i, p := range probs {
+				if math.Abs(float64(p.value-want[ids[i]])) > 1e-5 {
+					t.Errorf("token %d: want probability %f, got %f", ids[i], want[ids[i]], p.value)
+				}
+			}
+		})
+	}
+}
+
+func TestSchemaSampler(t *testing.T) {
+	tokenizer := modelHelper(t)
+
+	if _, err := NewSchemaSampler(tokenizer, []byte(`{"type": `)); err == nil {
+		t.Error("expected error for invalid schema")
+	}
+
+	schema := `{
+		"type": "object",
+		"properties": {
+			"color": {"enum": ["red", "blue"]},
+			"size": {"type": "number"}
+		},
+		"required": ["color", "size"]
+	}`
+	grammar, err := NewSchemaSampler(tokenizer, []byte(schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer grammar.Free()
+
+	vocab := tokenizer.Vocabulary()
+	allowed := func(piece string) bool {
+		id := vocab.Encode(piece)
+		if id < 0 {
+			t.Fatalf("%q is not in the vocabulary", piece)
+		}
+
+		tokens := []token{{id: id, value: 1}}
+		grammar.Apply(tokens)
+		return !math.IsInf(float64(tokens[0].value), -1)
+	}
+
+	// walk through {"color":"red","size":3} checking that each piece is
+	// permitted and that schema-invalid alternatives are rejected
+	steps := []struct {
+		piece    string
+		rejected []string
+	}{
+		{`{"`, []string{`[`, `3`, `"`}},
+		{`color`, []string{`size`, `name`}},
+		{`":"`, nil},
+		{`red`, []string{`green`, `3`}},
+		{`","`, []string{`}`}},
+		{`size`, []string{`color`}},
+		{`":`, nil},
+		{`3`, []string{`"`, `red`}},
+		{`}`, nil},
+	}
+
+	for _, step := range steps {
+		for _, piece := range step.rejected {
+			if allowed(piece) {
+				t.Errorf("%q should be rejected before %q", piece, step.piece)
+			}
+		}
+
+		if !allowed(step.piece) {
+			t.Fatalf("%q should be allowed", step.piece)
+		}
+		grammar.Accept(vocab.Encode(step.piece))
+	}
+}
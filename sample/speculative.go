@@ -0,0 +1,145 @@
+package sample
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// VerifyDraft decides whether to accept a token proposed by a draft model
+// during speculative decoding. target holds the target model's logits and
+// draft holds the draft model's probabilities over the same vocabulary.
+//
+// The target distribution is the one the sampler would sample from, after its
+// constraints, grammar and truncation, additionally limited to the k most
+// likely tokens which bounds the cost of verification. The draft token is
+// accepted with probability min(1, p/q), where p and q are the target and
+// draft probabilities of the token. Otherwise a replacement is sampled from
+// the residual distribution max(0, p-q). A temperature of 0 accepts only the
+// target's most likely token. The returned token is recorded by the sampler's
+// grammar and constraints as if it had been sampled.
+func (s *Sampler) VerifyDraft(draftToken int32, draft, target []float32, k int) (int32, bool, error) {
+	if len(target) == 0 {
+		return -1, false, ErrEmptyLogits
+	}
+
+	if len(draft) != len(target) {
+		return -1, false, errors.New("sample: draft and target distributions have different sizes")
+	}
+
+	if draftToken < 0 || int(draftToken) >= len(target) {
+		return -1, false, errors.New("sample: draft token out of range")
+	}
+
+	tokens := make([]token, len(target))
+	if err := s.reset(context.Background(), tokens, target); err != nil {
+		return -1, false, err
+	}
+
+	if s.grammar != nil {
+		s.grammar.Apply(tokens)
+		if !hasCandidates(tokens) {
+			return -1, false, fmt.Errorf("%w after applying grammar", ErrNoCandidates)
+		}
+	}
+
+	id, accepted, err := s.verify(draftToken, draft, tokens, k)
+	if err != nil {
+		return -1, false, err
+	}
+
+	if s.grammar != nil {
+		s.grammar.Accept(id)
+	}
+
+	for _, c := range s.constraints {
+		c.accept(id)
+	}
+
+	return id, accepted, nil
+}
+
+// verify accepts or replaces the draft token given the constrained target
+// tokens. It has side effects of modifying the tokens
+func (s *Sampler) verify(draftToken int32, draft []float32, tokens []token, k int) (int32, bool, error) {
+	if s.temperature == 0 {
+		t := greedy(tokens)
+		return t.id, t.id == draftToken, nil
+	}
+
+	// the sampler's own top-k still applies if it is tighter
+	if s.topK > 0 && (k <= 0 || s.topK < k) {
+		k = s.topK
+	}
+
+	tokens, err := s.distribution(context.Background(), tokens, k, nil)
+	if err != nil {
+		return -1, false, err
+	}
+
+	// top-p and min-p leave the kept probabilities unnormalized, which would
+	// skew both the acceptance test and the residual away from the target
+	var total float32
+	for _, t := range tokens {
+		total += t.value
+	}
+	if math.IsNaN(float64(total)) {
+		return -1, false, errNaN
+	}
+	for i := range tokens {
+		tokens[i].value /= total
+	}
+
+	var p float32
+	for _, t := range tokens {
+		if t.id == draftToken {
+			p = t.value
+			break
+		}
+	}
+
+	q := draft[draftToken]
+	if p > 0 && (q <= p || s.random() < p/q) {
+		return draftToken, true, nil
+	}
+
+	// resample from the residual distribution, falling back to the target
+	// distribution if the draft matches it everywhere
+	residual := make([]token, len(tokens))
+	var sum float32
+	for i, t := range tokens {
+		residual[i].id = t.id
+		residual[i].value = max(0, t.value-draft[t.id])
+		sum += residual[i].value
+	}
+
+	if sum <= 0 {
+		residual = tokens
+		sum = 0
+		for _, t := range tokens {
+			sum += t.value
+		}
+	}
+
+	if math.IsNaN(float64(sum)) {
+		return -1, false, errNaN
+	}
+
+	// only a single draw is taken so a cumulative search is cheaper than
+	// building an alias table
+	r := s.random() * sum
+	last := residual[0].id
+	for _, t := range residual {
+		if t.value <= 0 {
+			continue
+		}
+
+		last = t.id
+		if r -= t.value; r < 0 {
+			break
+		}
+	}
+
+	return last, false, nil
+}
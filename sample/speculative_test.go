@@ -0,0 +1,186 @@
+package sample
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestVerifyDraft(t *testing.T) {
+	t.Run("Accept", func(t *testing.T) {
+		// the target is more confident in the draft token than the draft model
+		target := []float32{5, 0, 0, 0}
+		draft := []float32{0.4, 0.2, 0.2, 0.2}
+
+		sampler := NewSampler(1, 2, 1, 0, 42, nil)
+		for range 100 {
+			got, accepted, err := sampler.VerifyDraft(0, draft, target, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !accepted || got != 0 {
+				t.Fatalf("draft should be accepted, got %d accepted %v", got, accepted)
+			}
+		}
+	})
+
+	t.Run("OutsideTopK", func(t *testing.T) {
+		target := []float32{3, 2, 1, 0}
+		draft := []float32{0, 0, 0, 1}
+
+		sampler := NewSampler(1, 2, 1, 0, 42, nil)
+		for range 100 {
+			got, accepted, err := sampler.VerifyDraft(3, draft, target, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if accepted {
+				t.Fatal("draft outside the top k should be rejected")
+			}
+			if got != 0 && got != 1 {
+				t.Fatalf("resampled token %d is outside the top k", got)
+			}
+		}
+	})
+
+	t.Run("Residual", func(t *testing.T) {
+		// the target splits evenly between tokens 0 and 1 while the draft
+		// overestimates token 0, so the residual only contains token 1
+		target := []float32{1, 1, -10, -10}
+		draft := []float32{0.9, 0.1, 0, 0}
+
+		sampler := NewSampler(1, 2, 1, 0, 42, nil)
+		var accepts, rejects int
+		for range 1000 {
+			got, accepted, err := sampler.VerifyDraft(0, draft, target, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if accepted {
+				accepts++
+				if got != 0 {
+					t.Fatalf("accepted token should be the draft, got %d", got)
+				}
+				continue
+			}
+
+			rejects++
+			if got != 1 {
+				t.Fatalf("resampled token should come from the residual, got %d", got)
+			}
+		}
+
+		// acceptance probability is 0.5 / 0.9
+		if accepts < 450 || accepts > 660 {
+			t.Errorf("unexpected acceptance rate: %d accepted, %d rejected", accepts, rejects)
+		}
+	})
+
+	t.Run("Greedy", func(t *testing.T) {
+		target := []float32{1, 3, 2}
+		draft := []float32{1, 0, 0}
+
+		sampler := NewSampler(0, 0, 0, 0, 0, nil)
+		got, accepted, err := sampler.VerifyDraft(0, draft, target, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accepted || got != 1 {
+			t.Errorf("want rejection with token 1, got %d accepted %v", got, accepted)
+		}
+
+		got, accepted, err = sampler.VerifyDraft(1, draft, target, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !accepted || got != 1 {
+			t.Errorf("want acceptance of token 1, got %d accepted %v", got, accepted)
+		}
+	})
+
+	t.Run("Constraints", func(t *testing.T) {
+		// the draft token is the target's favourite but it is banned
+		target := []float32{5, 1, 0, 0}
+		draft := []float32{0.7, 0.1, 0.1, 0.1}
+
+		recorder := &slowConstraint{}
+		sampler := NewSampler(1, 0, 1, 0, 42, nil, NewBannedTokens([]int32{0}), recorder)
+		for range 100 {
+			got, accepted, err := sampler.VerifyDraft(0, draft, target, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if accepted || got == 0 {
+				t.Fatalf("banned draft token should be rejected, got %d accepted %v", got, accepted)
+			}
+		}
+
+		// verified tokens are recorded like sampled ones
+		if len(recorder.accepted) != 100 || slices.Contains(recorder.accepted, 0) {
+			t.Errorf("constraints should record the verified tokens, got %v", recorder.accepted)
+		}
+	})
+
+	t.Run("TopP", func(t *testing.T) {
+		// top_p only keeps token 0, so the draft token 1 is never accepted
+		target := []float32{5, 1, 0, 0}
+		draft := []float32{0.1, 0.9, 0, 0}
+
+		sampler := NewSampler(1, 0, 0.5, 0, 42, nil)
+		for range 100 {
+			got, accepted, err := sampler.VerifyDraft(1, draft, target, 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if accepted || got != 0 {
+				t.Fatalf("draft outside top_p should be replaced by token 0, got %d accepted %v", got, accepted)
+			}
+		}
+	})
+
+	t.Run("Renormalized", func(t *testing.T) {
+		// top_p keeps tokens 0 and 1, so the draft token is accepted with its
+		// probability renormalized over the kept tokens
+		target := []float32{1, 0.8, 0, 0}
+		draft := []float32{1, 0, 0, 0}
+		want := math.Exp(1) / (math.Exp(1) + math.Exp(0.8))
+
+		for _, tc := range []struct {
+			name    string
+			sampler Sampler
+		}{
+			{"TopP", NewSampler(1, 0, 0.7, 0, 42, nil)},
+			{"MinP", NewSampler(1, 0, 1, 0.5, 42, nil)},
+		} {
+			const runs = 20000
+			var accepts int
+			for range runs {
+				got, accepted, err := tc.sampler.VerifyDraft(0, draft, target, 4)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if accepted {
+					accepts++
+				} else if got != 1 {
+					t.Fatalf("%s: resampled token should come from the residual, got %d", tc.name, got)
+				}
+			}
+
+			if got := float64(accepts) / runs; math.Abs(got-want) > 0.02 {
+				t.Errorf("%s: want acceptance rate %f, got %f", tc.name, want, got)
+			}
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		sampler := NewSampler(1, 2, 1, 0, 42, nil)
+		if _, _, err := sampler.VerifyDraft(0, []float32{1}, []float32{1, 2}, 2); err == nil {
+			t.Error("expected error for mismatched sizes")
+		}
+		if _, _, err := sampler.VerifyDraft(5, []float32{1, 0}, []float32{1, 2}, 2); err == nil {
+			t.Error("expected error for out of range draft token")
+		}
+	})
+}
@@ -1,16 +1,21 @@
 package sample
 
 import (
+	"cmp"
 	"container/heap"
+	"fmt"
+	"log/slog"
 	"math"
 	"slices"
+	"strings"
+	"unicode/utf8"
 )
 
 // tokenHeap implements heap.Interface and holds tokens as a min-heap to track k largest elements
 type tokenHeap []token
 
 func (h tokenHeap) Len() int           { return len(h) }
-func (h tokenHeap) Less(i, j int) bool { return h[i].value < h[j].value }
+func (h tokenHeap) Less(i, j int) bool { return compareTokens(h[i], h[j]) > 0 }
 func (h tokenHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
 
 func (h *tokenHeap) Push(x any) {
@@ -25,6 +30,19 @@ func (h *tokenHeap) Pop() any {
 	return x
 }
 
+// compareTokens orders tokens by descending value, breaking ties by ascending
+// id so that truncation is deterministic when values are equal
+func compareTokens(a, b token) int {
+	switch {
+	case a.value < b.value:
+		return 1
+	case a.value > b.value:
+		return -1
+	default:
+		return cmp.Compare(a.id, b.id)
+	}
+}
+
 // temperature applies scaling to the logits
 func temperature(ts []token, temp float32) {
 	// Ensure temperature clipping near 0 to avoid numerical instability
@@ -57,19 +75,17 @@ func softmax(ts []token) {
 	}
 }
 
+// logProbs converts normalized probabilities back to logits
+func logProbs(ts []token) {
+	for i := range ts {
+		ts[i].value = float32(math.Log(float64(ts[i].value)))
+	}
+}
+
 // topK limits the number of tokens considered to the k highest logits
 func topK(ts []token, k int) []token {
 	if k >= len(ts) || k <= 0 {
-		slices.SortFunc(ts, func(a, b token) int {
-			switch {
-			case a.value < b.value:
-				return 1
-			case a.value > b.value:
-				return -1
-			default:
-				return 0
-			}
-		})
+		slices.SortFunc(ts, compareTokens)
 		return ts
 	}
 
@@ -80,7 +96,7 @@ func topK(ts []token, k int) []token {
 
 	// Process remaining elements
 	for i := k; i < len(ts); i++ {
-		if ts[i].value > h[0].value {
+		if compareTokens(ts[i], h[0]) < 0 {
 			heap.Pop(&h)
 			heap.Push(&h, ts[i])
 		}
@@ -116,6 +132,11 @@ func topP(ts []token, p float32) []token {
 
 // minP filters tokens with probabilities >= p * max_prob
 // requires ts to be sorted in descending order of probabilities
+//
+// max_prob is the highest probability of the tokens minP receives, so when
+// applied after topK or topP the threshold is relative to the most likely
+// remaining token. The probabilities do not need to be renormalized after
+// truncation since only their ratio to max_prob matters.
 func minP(ts []token, p float32) []token {
 	maxProb := ts[0].value
 
@@ -128,3 +149,755 @@ func minP(ts []token, p float32) []token {
 	}
 	return ts
 }
+
+// Transitions is a finite-state constraint that only allows specific tokens
+// to follow the previously sampled token. Tokens without an entry in the
+// transition table may be followed by any token.
+type Transitions struct {
+	allowed map[int32]map[int32]struct{}
+	last    int32
+	started bool
+}
+
+// NewTransitions creates a constraint from a table mapping a token id to the
+// token ids which may follow it
+func NewTransitions(allowed map[int32][]int32) *Transitions {
+	t := &Transitions{allowed: make(map[int32]map[int32]struct{}, len(allowed))}
+	for id, next := range allowed {
+		set := make(map[int32]struct{}, len(next))
+		for _, n := range next {
+			set[n] = struct{}{}
+		}
+		t.allowed[id] = set
+	}
+
+	return t
+}
+
+func (t *Transitions) apply(ts []token) {
+	if !t.started {
+		return
+	}
+
+	allowed, ok := t.allowed[t.last]
+	if !ok {
+		return
+	}
+
+	for i := range ts {
+		if _, ok := allowed[ts[i].id]; !ok {
+			ts[i].value = float32(math.Inf(-1))
+		}
+	}
+}
+
+func (t *Transitions) accept(id int32) {
+	t.last = id
+	t.started = true
+}
+
+func (t *Transitions) name() string { return "transitions" }
+
+// entropy returns the Shannon entropy in nats of normalized probabilities
+func entropy(ts []token) float32 {
+	var h float64
+	for _, t := range ts {
+		if t.value > 0 {
+			h -= float64(t.value) * math.Log(float64(t.value))
+		}
+	}
+
+	return float32(h)
+}
+
+// confidence scores how decisive a distribution is from 0 to 1. The
+// probabilities do not need to be sorted or normalized.
+func confidence(ts []token, metric ConfidenceMetric) float32 {
+	if len(ts) < 2 {
+		return 1
+	}
+
+	var sum float32
+	for _, t := range ts {
+		sum += t.value
+	}
+	if sum <= 0 || math.IsNaN(float64(sum)) {
+		return 0
+	}
+
+	switch metric {
+	case ConfidenceEntropy:
+		probs := make([]token, len(ts))
+		for i, t := range ts {
+			probs[i].value = t.value / sum
+		}
+		return 1 - entropy(probs)/float32(math.Log(float64(len(ts))))
+	default:
+		var first, second float32
+		for _, t := range ts {
+			if t.value > first {
+				first, second = t.value, first
+			} else if t.value > second {
+				second = t.value
+			}
+		}
+		return (first - second) / sum
+	}
+}
+
+// AdaptiveTopK is a constraint that limits the candidates to the k highest
+// logits, where k is chosen between minK and maxK according to the entropy
+// of the distribution. Flat distributions keep more candidates than peaked
+// ones, reaching maxK once the entropy meets the target.
+type AdaptiveTopK struct {
+	minK, maxK    int
+	targetEntropy float32
+}
+
+func NewAdaptiveTopK(minK, maxK int, targetEntropy float32) *AdaptiveTopK {
+	minK = max(minK, 1)
+	maxK = max(maxK, minK)
+	if targetEntropy <= 0 {
+		targetEntropy = 1
+	}
+
+	return &AdaptiveTopK{minK: minK, maxK: maxK, targetEntropy: targetEntropy}
+}
+
+// k returns the number of candidates to keep for the given logits
+func (a *AdaptiveTopK) k(ts []token) int {
+	probs := slices.Clone(ts)
+	softmax(probs)
+
+	ratio := min(entropy(probs)/a.targetEntropy, 1)
+	k := a.minK + int(math.Round(float64(ratio)*float64(a.maxK-a.minK)))
+	return min(k, len(ts))
+}
+
+func (a *AdaptiveTopK) apply(ts []token) {
+	if k := a.k(ts); k < len(ts) {
+		maskTopK(ts, k)
+	}
+}
+
+// maskTopK masks all but the k highest logits in place without reordering
+// the tokens and returns the positions of the remaining tokens in descending
+// order of logits
+func maskTopK(ts []token, k int) []int {
+	// track positions rather than ids so the kept tokens can be found
+	positions := make([]token, len(ts))
+	for i, t := range ts {
+		positions[i] = token{id: int32(i), value: t.value}
+	}
+
+	keep := make([]bool, len(ts))
+	kept := make([]int, 0, min(k, len(ts)))
+	for _, t := range topK(positions, k) {
+		keep[t.id] = true
+		kept = append(kept, int(t.id))
+	}
+
+	for i := range ts {
+		if !keep[i] {
+			ts[i].value = float32(math.Inf(-1))
+		}
+	}
+
+	return kept
+}
+
+func (a *AdaptiveTopK) accept(int32) {}
+
+func (a *AdaptiveTopK) name() string { return "adaptive_top_k" }
+
+// Canonical maps token ids to a canonical id, such as when a tokenizer has
+// several ids with the same surface text. Constraints that support it treat
+// all variants of a canonical token as that token. Ids without an entry are
+// their own canonical id.
+type Canonical map[int32]int32
+
+func (c Canonical) id(id int32) int32 {
+	if canonical, ok := c[id]; ok {
+		return canonical
+	}
+	return id
+}
+
+// set returns the canonical ids of the given tokens
+func (c Canonical) set(ids []int32) map[int32]struct{} {
+	set := make(map[int32]struct{}, len(ids))
+	for _, id := range ids {
+		set[c.id(id)] = struct{}{}
+	}
+	return set
+}
+
+// BannedTokens is a constraint that masks a fixed set of tokens
+type BannedTokens struct {
+	ids       []int32
+	banned    map[int32]struct{}
+	canonical Canonical
+}
+
+func NewBannedTokens(ids []int32) *BannedTokens {
+	b := &BannedTokens{ids: ids}
+	b.SetCanonical(nil)
+	return b
+}
+
+// SetCanonical makes banning any variant of a token ban all of its variants
+func (b *BannedTokens) SetCanonical(c Canonical) {
+	b.canonical = c
+	b.banned = c.set(b.ids)
+}
+
+func (b *BannedTokens) apply(ts []token) {
+	for i := range ts {
+		if _, ok := b.banned[b.canonical.id(ts[i].id)]; ok {
+			ts[i].value = float32(math.Inf(-1))
+		}
+	}
+}
+
+func (b *BannedTokens) accept(int32) {}
+
+func (b *BannedTokens) name() string { return "banned_tokens" }
+
+// AllowedTokens is a constraint that masks every token outside a fixed set
+type AllowedTokens struct {
+	ids       []int32
+	allowed   map[int32]struct{}
+	canonical Canonical
+}
+
+func NewAllowedTokens(ids []int32) *AllowedTokens {
+	a := &AllowedTokens{ids: ids}
+	a.SetCanonical(nil)
+	return a
+}
+
+// SetCanonical makes allowing any variant of a token allow all of its variants
+func (a *AllowedTokens) SetCanonical(c Canonical) {
+	a.canonical = c
+	a.allowed = c.set(a.ids)
+}
+
+func (a *AllowedTokens) apply(ts []token) {
+	for i := range ts {
+		if _, ok := a.allowed[a.canonical.id(ts[i].id)]; !ok {
+			ts[i].value = float32(math.Inf(-1))
+		}
+	}
+}
+
+func (a *AllowedTokens) accept(int32) {}
+
+func (a *AllowedTokens) name() string { return "allowed_tokens" }
+
+// Penalties is a constraint that discourages repeating tokens sampled within
+// a sliding window of the most recent tokens. Tokens that scroll out of the
+// window are no longer penalized.
+type Penalties struct {
+	repeat    float32
+	frequency float32
+	presence  float32
+
+	window []int32
+	next   int
+	full   bool
+	counts map[int32]int
+
+	canonical Canonical
+}
+
+// NewPenalties creates a penalty constraint over the last window tokens.
+// A repeat penalty of 1 and frequency and presence penalties of 0 disable the
+// respective penalty.
+func NewPenalties(window int, repeat, frequency, presence float32) (*Penalties, error) {
+	if window < 1 {
+		return nil, fmt.Errorf("sample: penalty window must be at least 1, got %d", window)
+	}
+
+	if repeat <= 0 {
+		return nil, fmt.Errorf("sample: repeat penalty must be positive, got %f", repeat)
+	}
+
+	return &Penalties{
+		repeat:    repeat,
+		frequency: frequency,
+		presence:  presence,
+		window:    make([]int32, window),
+		counts:    make(map[int32]int),
+	}, nil
+}
+
+// SetCanonical makes variants of a token share its penalties, so repeating
+// any variant penalizes all of them. It must be set before tokens are accepted.
+func (p *Penalties) SetCanonical(c Canonical) {
+	p.canonical = c
+}
+
+func (p *Penalties) apply(ts []token) {
+	if len(p.counts) == 0 {
+		return
+	}
+
+	for i := range ts {
+		count, ok := p.counts[p.canonical.id(ts[i].id)]
+		if !ok {
+			continue
+		}
+
+		// match llama.cpp: shrink positive logits and grow negative ones
+		if ts[i].value > 0 {
+			ts[i].value /= p.repeat
+		} else {
+			ts[i].value *= p.repeat
+		}
+
+		ts[i].value -= float32(count)*p.frequency + p.presence
+	}
+}
+
+func (p *Penalties) accept(id int32) {
+	id = p.canonical.id(id)
+	if p.full {
+		old := p.window[p.next]
+		p.counts[old]--
+		if p.counts[old] == 0 {
+			delete(p.counts, old)
+		}
+	}
+
+	p.window[p.next] = id
+	p.counts[id]++
+
+	p.next++
+	if p.next == len(p.window) {
+		p.next = 0
+		p.full = true
+	}
+}
+
+func (p *Penalties) name() string { return "penalties" }
+
+// BiasVector is a constraint that adds a per-token bias to every logit,
+// such as a steering vector precomputed by a control model
+type BiasVector struct {
+	bias []float32
+}
+
+// NewBiasVector creates a bias constraint. The bias must have exactly one
+// entry per logit, otherwise sampling returns an error.
+func NewBiasVector(bias []float32) *BiasVector {
+	return &BiasVector{bias: bias}
+}
+
+func (b *BiasVector) checkSize(n int) error {
+	if len(b.bias) != n {
+		return fmt.Errorf("sample: bias vector has %d entries but there are %d logits", len(b.bias), n)
+	}
+
+	return nil
+}
+
+func (b *BiasVector) apply(ts []token) {
+	for i := range ts {
+		if id := int(ts[i].id); id < len(b.bias) {
+			ts[i].value += b.bias[id]
+		}
+	}
+}
+
+func (b *BiasVector) accept(int32) {}
+
+func (b *BiasVector) name() string { return "bias_vector" }
+
+// FlatTail is a constraint that sharpens the distribution when its entropy
+// exceeds a threshold, discouraging low confidence tokens. The logits are
+// scaled by 1 + strength * (entropy - threshold), which is equivalent to
+// lowering the temperature in proportion to how flat the distribution is.
+type FlatTail struct {
+	threshold float32
+	strength  float32
+}
+
+func NewFlatTail(threshold, strength float32) *FlatTail {
+	return &FlatTail{threshold: max(threshold, 0), strength: max(strength, 0)}
+}
+
+func (f *FlatTail) apply(ts []token) {
+	probs := slices.Clone(ts)
+	softmax(probs)
+
+	h := entropy(probs)
+	if h <= f.threshold {
+		return
+	}
+
+	scale := 1 + f.strength*(h-f.threshold)
+	for i := range ts {
+		ts[i].value *= scale
+	}
+}
+
+func (f *FlatTail) accept(int32) {}
+
+func (f *FlatTail) name() string { return "flat_tail" }
+
+// TokenHealing is a constraint for token healing, where the trailing token
+// of the prompt is removed and regenerated to avoid tokenization artifacts
+// at the prompt boundary. The first sampled token must begin with the text
+// of the removed token, after which the constraint has no effect.
+type TokenHealing struct {
+	prefix string
+	decode func(int32) string
+	healed bool
+}
+
+// NewTokenHealing creates a token healing constraint where prefix is the text
+// of the removed prompt token and decode maps a token id to its text
+func NewTokenHealing(prefix string, decode func(int32) string) *TokenHealing {
+	return &TokenHealing{prefix: prefix, decode: decode, healed: prefix == ""}
+}
+
+func (h *TokenHealing) apply(ts []token) {
+	if h.healed {
+		return
+	}
+
+	for i := range ts {
+		if !strings.HasPrefix(h.decode(ts[i].id), h.prefix) {
+			ts[i].value = float32(math.Inf(-1))
+		}
+	}
+}
+
+func (h *TokenHealing) accept(int32) {
+	h.healed = true
+}
+
+func (h *TokenHealing) name() string { return "token_healing" }
+
+// BannedSubstrings is a constraint that masks any token that would complete
+// one of the banned substrings, including substrings that span several tokens
+type BannedSubstrings struct {
+	banned []string
+	decode func(int32) string
+
+	// tail holds the end of the text generated so far, long enough to detect
+	// banned substrings that started in earlier tokens
+	tail    string
+	maxTail int
+}
+
+// NewBannedSubstrings creates a constraint where text is the text generated so
+// far, such as the end of the prompt, and decode maps a token id to its text
+func NewBannedSubstrings(banned []string, text string, decode func(int32) string) *BannedSubstrings {
+	b := &BannedSubstrings{decode: decode}
+	for _, s := range banned {
+		if s != "" {
+			b.banned = append(b.banned, s)
+			b.maxTail = max(b.maxTail, len(s)-1)
+		}
+	}
+
+	b.setTail(text)
+	return b
+}
+
+func (b *BannedSubstrings) setTail(text string) {
+	if len(text) > b.maxTail {
+		text = text[len(text)-b.maxTail:]
+	}
+	b.tail = text
+}
+
+func (b *BannedSubstrings) apply(ts []token) {
+	if len(b.banned) == 0 {
+		return
+	}
+
+	for i := range ts {
+		text := b.tail + b.decode(ts[i].id)
+		for _, s := range b.banned {
+			// only consider matches that end in the candidate token
+			if strings.Contains(text[max(0, len(b.tail)-len(s)+1):], s) {
+				ts[i].value = float32(math.Inf(-1))
+				break
+			}
+		}
+	}
+}
+
+func (b *BannedSubstrings) accept(id int32) {
+	b.setTail(b.tail + b.decode(id))
+}
+
+func (b *BannedSubstrings) name() string { return "banned_substrings" }
+
+// PromptCopy is a constraint that penalizes tokens that would extend a
+// verbatim copy of the prompt beyond a maximum length
+type PromptCopy struct {
+	prompt  []int32
+	maxLen  int
+	penalty float32
+
+	// lengths[p] is the length of the copied span ending at prompt[p] that
+	// matches the end of the generated text, or 0 if there is none
+	lengths []int
+}
+
+// NewPromptCopy creates a constraint where generated holds the tokens generated
+// so far. A penalty of +Inf masks copy-continuing tokens entirely.
+func NewPromptCopy(prompt, generated []int32, maxLen int, penalty float32) (*PromptCopy, error) {
+	if maxLen < 1 {
+		return nil, fmt.Errorf("sample: prompt copy length must be at least 1, got %d", maxLen)
+	}
+
+	if penalty < 0 {
+		return nil, fmt.Errorf("sample: prompt copy penalty must be non-negative, got %f", penalty)
+	}
+
+	c := &PromptCopy{
+		prompt:  prompt,
+		maxLen:  maxLen,
+		penalty: penalty,
+		lengths: make([]int, len(prompt)),
+	}
+
+	for _, id := range generated {
+		c.accept(id)
+	}
+
+	return c, nil
+}
+
+func (c *PromptCopy) apply(ts []token) {
+	// tokens that would extend a copy already at the maximum length
+	var extends map[int32]struct{}
+	for p, n := range c.lengths[:max(0, len(c.lengths)-1)] {
+		if n >= c.maxLen {
+			if extends == nil {
+				extends = make(map[int32]struct{})
+			}
+			extends[c.prompt[p+1]] = struct{}{}
+		}
+	}
+
+	if extends == nil {
+		return
+	}
+
+	for i := range ts {
+		if _, ok := extends[ts[i].id]; ok {
+			ts[i].value -= c.penalty
+		}
+	}
+}
+
+func (c *PromptCopy) accept(id int32) {
+	// walk backwards so lengths[p-1] still holds the previous step's value
+	for p := len(c.prompt) - 1; p >= 0; p-- {
+		switch {
+		case c.prompt[p] != id:
+			c.lengths[p] = 0
+		case p > 0:
+			c.lengths[p] = c.lengths[p-1] + 1
+		default:
+			c.lengths[p] = 1
+		}
+	}
+}
+
+func (c *PromptCopy) name() string { return "prompt_copy" }
+
+// Antislop is a constraint that masks any token that would complete one of
+// the banned phrases, ignoring ASCII case. Partial matches are tracked as
+// positions in a trie of the phrases, so each candidate only needs to walk
+// forward from the current matches without rescanning earlier text.
+type Antislop struct {
+	root   *trieNode
+	decode func(int32) string
+
+	// active holds the trie nodes matched by suffixes of the generated text
+	active []*trieNode
+}
+
+type trieNode struct {
+	next map[byte]*trieNode
+	end  bool
+}
+
+// NewAntislop creates a constraint where decode maps a token id to its text
+func NewAntislop(phrases []string, decode func(int32) string) *Antislop {
+	root := &trieNode{next: make(map[byte]*trieNode)}
+	for _, phrase := range phrases {
+		if phrase == "" {
+			continue
+		}
+
+		n := root
+		for i := range len(phrase) {
+			c := lowerASCII(phrase[i])
+			child, ok := n.next[c]
+			if !ok {
+				child = &trieNode{next: make(map[byte]*trieNode)}
+				n.next[c] = child
+			}
+			n = child
+		}
+		n.end = true
+	}
+
+	return &Antislop{root: root, decode: decode}
+}
+
+func lowerASCII(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// advance walks the active matches forward over text, reporting whether a
+// banned phrase was completed
+func (a *Antislop) advance(active []*trieNode, text string) ([]*trieNode, bool) {
+	for i := range len(text) {
+		c := lowerASCII(text[i])
+
+		// a new match may start at every byte
+		var next []*trieNode
+		for _, n := range active {
+			if child, ok := n.next[c]; ok {
+				if child.end {
+					return nil, true
+				}
+				next = append(next, child)
+			}
+		}
+		if child, ok := a.root.next[c]; ok {
+			if child.end {
+				return nil, true
+			}
+			next = append(next, child)
+		}
+
+		active = next
+	}
+
+	return active, false
+}
+
+func (a *Antislop) apply(ts []token) {
+	if len(a.root.next) == 0 {
+		return
+	}
+
+	for i := range ts {
+		if _, banned := a.advance(a.active, a.decode(ts[i].id)); banned {
+			ts[i].value = float32(math.Inf(-1))
+		}
+	}
+}
+
+func (a *Antislop) accept(id int32) {
+	// a banned phrase can only complete here if the caller ignored the mask,
+	// in which case matching restarts after it
+	a.active, _ = a.advance(a.active, a.decode(id))
+}
+
+func (a *Antislop) name() string { return "antislop" }
+
+// Reranker is a constraint that restricts the candidates to the k highest
+// logits and adjusts them with scores from an external scorer. Scores are
+// added to the logits, so a score of s multiplies a token's probability by
+// e^s before the distribution is renormalized.
+type Reranker struct {
+	k      int
+	scorer func(ids []int32) []float32
+}
+
+// NewReranker creates a reranking constraint. scorer receives the ids of the
+// k most likely tokens and returns a score for each of them.
+func NewReranker(k int, scorer func(ids []int32) []float32) *Reranker {
+	return &Reranker{k: max(k, 1), scorer: scorer}
+}
+
+func (r *Reranker) apply(ts []token) {
+	// tokens masked by earlier constraints can be kept when fewer than k
+	// candidates remain, but they can never be sampled so are not scored
+	kept := slices.DeleteFunc(maskTopK(ts, r.k), func(pos int) bool {
+		return math.IsInf(float64(ts[pos].value), -1)
+	})
+	if len(kept) == 0 {
+		return
+	}
+
+	ids := make([]int32, len(kept))
+	for i, pos := range kept {
+		ids[i] = ts[pos].id
+	}
+
+	scores := r.scorer(ids)
+	if len(scores) != len(ids) {
+		slog.Warn("reranker returned the wrong number of scores, ignoring", "want", len(ids), "got", len(scores))
+		return
+	}
+
+	for i, pos := range kept {
+		ts[pos].value += scores[i]
+	}
+}
+
+func (r *Reranker) accept(int32) {}
+
+func (r *Reranker) name() string { return "reranker" }
+
+// UTF8 is a constraint for byte-level vocabularies that masks tokens which
+// would produce invalid UTF-8 when appended to the bytes generated so far,
+// such as a token that does not continue a partially generated character
+type UTF8 struct {
+	bytes   func(int32) []byte
+	pending []byte
+}
+
+// NewUTF8 creates a constraint where bytes maps a token id to the bytes it
+// produces
+func NewUTF8(bytes func(int32) []byte) *UTF8 {
+	return &UTF8{bytes: bytes}
+}
+
+// incomplete reports whether b is valid UTF-8, allowing a trailing partial
+// character, and returns the bytes of the partial character if there is one
+func incomplete(b []byte) (valid bool, partial []byte) {
+	for i := 0; i < len(b); {
+		if !utf8.FullRune(b[i:]) {
+			return true, b[i:]
+		}
+
+		r, size := utf8.DecodeRune(b[i:])
+		if r == utf8.RuneError && size == 1 {
+			return false, nil
+		}
+		i += size
+	}
+
+	return true, nil
+}
+
+func (u *UTF8) apply(ts []token) {
+	for i := range ts {
+		b := append(slices.Clip(u.pending), u.bytes(ts[i].id)...)
+		if valid, _ := incomplete(b); !valid {
+			ts[i].value = float32(math.Inf(-1))
+		}
+	}
+}
+
+func (u *UTF8) accept(id int32) {
+	_, partial := incomplete(append(u.pending, u.bytes(id)...))
+	u.pending = slices.Clone(partial)
+}
+
+func (u *UTF8) name() string { return "utf8" }
@@ -1,8 +1,11 @@
 package sample
 
 import (
+	"fmt"
 	"math"
 	"math/rand/v2"
+	"slices"
+	"strings"
 	"testing"
 )
 
@@ -118,6 +121,18 @@ func TestSoftmax(t *testing.T) {
 	}
 }
 
+func TestLogProbs(t *testing.T) {
+	input := []float32{1, -2, 3, 0}
+	tokens := toTokens(input)
+	softmax(tokens)
+	logProbs(tokens)
+	softmax(tokens)
+
+	want := toTokens(input)
+	softmax(want)
+	compareLogits(t, "logProbs", []float32{want[0].value, want[1].value, want[2].value, want[3].value}, tokens)
+}
+
 func TestTopK(t *testing.T) {
 	input := []float32{0.026986899, 0.043722924, 0.036774673, 0.27755088, 0.0046718004, 0.08582123, 0.20409796, 0.00412893, 0.15720603, 0.045046154, 0.0030491839, 0.01681367}
 	tokens := toTokens(input)
@@ -160,6 +175,42 @@ func TestTopK(t *testing.T) {
 	}
 }
 
+func TestTopKTies(t *testing.T) {
+	// tokens 1, 3, 4 and 6 tie at the boundary for both the heap and sort paths
+	input := []float32{5, 2, 3, 2, 2, 1, 2}
+
+	for _, k := range []int{3, 0} {
+		var want []int32
+		for range 20 {
+			tokens := toTokens(input)
+			rand.Shuffle(len(tokens), func(i, j int) {
+				tokens[i], tokens[j] = tokens[j], tokens[i]
+			})
+
+			var got []int32
+			for _, tok := range topK(tokens, k) {
+				got = append(got, tok.id)
+			}
+
+			if want == nil {
+				want = got
+				continue
+			}
+
+			if !slices.Equal(want, got) {
+				t.Fatalf("topK(%d): kept tokens changed between runs: %v, %v", k, want, got)
+			}
+		}
+
+		if k == 3 && !slices.Equal(want, []int32{0, 2, 1}) {
+			t.Errorf("topK(3): ties should keep the lowest id, got %v", want)
+		}
+		if k == 0 && !slices.Equal(want, []int32{0, 2, 1, 3, 4, 6, 5}) {
+			t.Errorf("topK(0): ties should sort by id, got %v", want)
+		}
+	}
+}
+
 func TestTopP(t *testing.T) {
 	input := []float32{-3, -2, -1, 0, 1, 2, 4}
 	tokens := toTokens(input)
@@ -295,6 +346,587 @@ func TestMinP(t *testing.T) {
 	}
 }
 
+func TestTransitions(t *testing.T) {
+	// tokens 0-9 are digits and 10 is a letter, a digit may only be followed by a digit
+	digits := []int32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	allowed := make(map[int32][]int32)
+	for _, d := range digits {
+		allowed[d] = digits
+	}
+	transitions := NewTransitions(allowed)
+
+	logits := []float32{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 5}
+
+	// nothing is masked before a token has been accepted
+	tokens := toTokens(logits)
+	transitions.apply(tokens)
+	compareLogits(t, "initial", logits, tokens)
+
+	// a letter may be followed by anything
+	transitions.accept(10)
+	tokens = toTokens(logits)
+	transitions.apply(tokens)
+	compareLogits(t, "after letter", logits, tokens)
+
+	// a digit may only be followed by a digit
+	transitions.accept(3)
+	tokens = toTokens(logits)
+	transitions.apply(tokens)
+	for _, tok := range tokens {
+		masked := math.IsInf(float64(tok.value), -1)
+		if tok.id == 10 && !masked {
+			t.Error("letter should be masked after a digit")
+		} else if tok.id != 10 && masked {
+			t.Errorf("digit %d should not be masked", tok.id)
+		}
+	}
+
+	// the sampler records sampled tokens and applies the constraint
+	sampler := NewSampler(0, 0, 0, 0, 0, nil, NewTransitions(allowed))
+	got, err := sampler.Sample([]float32{1, 1, 1, 1, 1, 1, 1, 5, 1, 1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 7 {
+		t.Errorf("want 7, got %d", got)
+	}
+
+	got, err = sampler.Sample([]float32{1, 1, 2, 1, 1, 1, 1, 1, 1, 1, 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 2 {
+		t.Errorf("letter should be masked after a digit, want 2, got %d", got)
+	}
+}
+
+func TestAdaptiveTopK(t *testing.T) {
+	a := NewAdaptiveTopK(2, 8, 2)
+
+	flat := make([]float32, 16)
+	peaked := []float32{10, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+
+	flatK := a.k(toTokens(flat))
+	peakedK := a.k(toTokens(peaked))
+	if flatK != 8 {
+		t.Errorf("flat distribution: want k 8, got %d", flatK)
+	}
+	if peakedK >= flatK || peakedK < 2 {
+		t.Errorf("peaked distribution: want k in [2, %d), got %d", flatK, peakedK)
+	}
+
+	tokens := toTokens(peaked)
+	a.apply(tokens)
+	var kept int
+	for _, tok := range tokens {
+		if !math.IsInf(float64(tok.value), -1) {
+			kept++
+		}
+	}
+	if kept != peakedK {
+		t.Errorf("want %d tokens kept, got %d", peakedK, kept)
+	}
+	if math.IsInf(float64(tokens[0].value), -1) || math.IsInf(float64(tokens[1].value), -1) {
+		t.Error("highest logits should be kept")
+	}
+
+	// k never exceeds the number of candidates
+	tokens = toTokens([]float32{1, 1, 1})
+	a.apply(tokens)
+	compareLogits(t, "small vocabulary", []float32{1, 1, 1}, tokens)
+}
+
+func TestCanonical(t *testing.T) {
+	// tokens 3 and 4 are variants of token 1
+	canonical := Canonical{3: 1, 4: 1}
+
+	masked := func(c Constraint) []int32 {
+		tokens := toTokens(make([]float32, 6))
+		c.apply(tokens)
+
+		var ids []int32
+		for _, tok := range tokens {
+			if math.IsInf(float64(tok.value), -1) {
+				ids = append(ids, tok.id)
+			}
+		}
+		return ids
+	}
+
+	b := NewBannedTokens([]int32{1, 5})
+	if want, got := []int32{1, 5}, masked(b); !slices.Equal(want, got) {
+		t.Errorf("banned: want %v masked, got %v", want, got)
+	}
+
+	b.SetCanonical(canonical)
+	if want, got := []int32{1, 3, 4, 5}, masked(b); !slices.Equal(want, got) {
+		t.Errorf("banned canonical: want %v masked, got %v", want, got)
+	}
+
+	a := NewAllowedTokens([]int32{1})
+	a.SetCanonical(canonical)
+	if want, got := []int32{0, 2, 5}, masked(a); !slices.Equal(want, got) {
+		t.Errorf("allowed canonical: want %v masked, got %v", want, got)
+	}
+
+	// listing a variant affects its canonical token and the other variants
+	b = NewBannedTokens([]int32{4})
+	b.SetCanonical(canonical)
+	if want, got := []int32{1, 3, 4}, masked(b); !slices.Equal(want, got) {
+		t.Errorf("banned variant: want %v masked, got %v", want, got)
+	}
+
+	a = NewAllowedTokens([]int32{3})
+	a.SetCanonical(canonical)
+	if want, got := []int32{0, 2, 5}, masked(a); !slices.Equal(want, got) {
+		t.Errorf("allowed variant: want %v masked, got %v", want, got)
+	}
+
+	// the canonical map can be replaced
+	b.SetCanonical(nil)
+	if want, got := []int32{4}, masked(b); !slices.Equal(want, got) {
+		t.Errorf("banned without canonical map: want %v masked, got %v", want, got)
+	}
+
+	p, err := NewPenalties(4, 1, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetCanonical(canonical)
+
+	// each variant counts towards the same canonical token
+	for _, id := range []int32{1, 3, 4, 2} {
+		p.accept(id)
+	}
+
+	tokens := toTokens([]float32{0, 0, 0, 0, 0, 0})
+	p.apply(tokens)
+	compareLogits(t, "canonical penalties", []float32{0, -3, -1, -3, -3, 0}, tokens)
+}
+
+func TestPenalties(t *testing.T) {
+	if _, err := NewPenalties(0, 1.1, 0, 0); err == nil {
+		t.Error("expected error for empty window")
+	}
+
+	if _, err := NewPenalties(4, 0, 0, 0); err == nil {
+		t.Error("expected error for zero repeat penalty")
+	}
+
+	p, err := NewPenalties(3, 2, 0.5, 0.25)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []int32{0, 1, 1} {
+		p.accept(id)
+	}
+
+	tokens := toTokens([]float32{4, -4, 4, 4})
+	p.apply(tokens)
+	// 0: 4/2 - 0.5 - 0.25, 1: -4*2 - 2*0.5 - 0.25
+	compareLogits(t, "penalties", []float32{1.25, -9.25, 4, 4}, tokens)
+
+	// token 0 scrolls out of the window and token 2 enters it
+	p.accept(2)
+	tokens = toTokens([]float32{4, -4, 4, 4})
+	p.apply(tokens)
+	compareLogits(t, "window", []float32{4, -9.25, 1.25, 4}, tokens)
+
+	// the counts of token 1 decrease as its occurrences scroll out
+	p.accept(3)
+	p.accept(3)
+	tokens = toTokens([]float32{4, -4, 4, 4})
+	p.apply(tokens)
+	compareLogits(t, "scrolled", []float32{4, -4, 1.25, 0.75}, tokens)
+}
+
+func TestBiasVector(t *testing.T) {
+	b := NewBiasVector([]float32{0.5, -1, 0, 2})
+
+	tokens := toTokens([]float32{1, 2, 3, 4})
+	b.apply(tokens)
+	compareLogits(t, "bias", []float32{1.5, 1, 3, 6}, tokens)
+
+	// the bias follows token ids rather than positions
+	tokens = []token{{id: 3, value: 0}, {id: 0, value: 0}}
+	b.apply(tokens)
+	compareLogits(t, "bias by id", []float32{2, 0.5}, tokens)
+
+	// the bias changes the most likely token
+	sampler := NewSampler(0, 0, 0, 0, 0, nil, b)
+	got, err := sampler.Sample([]float32{1, 4, 3, 2.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 3 {
+		t.Errorf("want token 3, got %d", got)
+	}
+
+	// the bias must match the logits it is applied to
+	for _, logits := range [][]float32{{1, 2, 3}, {1, 2, 3, 4, 5}} {
+		_, err := sampler.Sample(logits)
+		if err == nil {
+			t.Errorf("%d logits: expected error for bias vector length mismatch", len(logits))
+		} else if !strings.Contains(err.Error(), "4 entries") || !strings.Contains(err.Error(), fmt.Sprintf("%d logits", len(logits))) {
+			t.Errorf("error should describe the mismatch: %v", err)
+		}
+	}
+}
+
+func TestFlatTail(t *testing.T) {
+	f := NewFlatTail(1, 2)
+
+	// entropy of the peaked distribution is below the threshold
+	peaked := []float32{10, 0, 0, 0}
+	tokens := toTokens(peaked)
+	f.apply(tokens)
+	compareLogits(t, "peaked", peaked, tokens)
+
+	flat := []float32{1, 0.9, 0.8, 0.7}
+	before := toTokens(flat)
+	softmax(before)
+
+	tokens = toTokens(flat)
+	f.apply(tokens)
+	softmax(tokens)
+
+	if tokens[0].value <= before[0].value {
+		t.Errorf("flat distribution should sharpen: max probability %f before, %f after", before[0].value, tokens[0].value)
+	}
+	if entropy(tokens) >= entropy(before) {
+		t.Errorf("flat distribution should sharpen: entropy %f before, %f after", entropy(before), entropy(tokens))
+	}
+
+	// masked tokens stay masked
+	tokens = toTokens([]float32{1, 1, 1, float32(math.Inf(-1))})
+	f.apply(tokens)
+	if !math.IsInf(float64(tokens[3].value), -1) {
+		t.Errorf("masked token should stay masked, got %f", tokens[3].value)
+	}
+}
+
+func TestTokenHealing(t *testing.T) {
+	vocab := []string{"http", "://", ":", ":/", "htt", "hello", " world"}
+	decode := func(id int32) string { return vocab[id] }
+
+	// the prompt "url: http:" was tokenized with a trailing ":" which is removed
+	h := NewTokenHealing(":", decode)
+	logits := []float32{1, 1, 1, 1, 1, 1, 1}
+
+	tokens := toTokens(logits)
+	h.apply(tokens)
+	var kept []string
+	for _, tok := range tokens {
+		if !math.IsInf(float64(tok.value), -1) {
+			kept = append(kept, vocab[tok.id])
+		}
+	}
+	if want := []string{"://", ":", ":/"}; !slices.Equal(want, kept) {
+		t.Errorf("want %v kept, got %v", want, kept)
+	}
+
+	// only the first token is constrained
+	sampler := NewSampler(0, 0, 0, 0, 0, nil, h)
+	got, err := sampler.Sample([]float32{5, 3, 1, 1, 1, 1, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 1 {
+		t.Errorf("want \"://\", got %q", vocab[got])
+	}
+
+	got, err = sampler.Sample([]float32{5, 3, 1, 1, 1, 1, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 0 {
+		t.Errorf("want \"http\", got %q", vocab[got])
+	}
+
+	// an empty prefix does not constrain anything
+	tokens = toTokens(logits)
+	NewTokenHealing("", decode).apply(tokens)
+	compareLogits(t, "empty prefix", logits, tokens)
+}
+
+func TestPromptCopy(t *testing.T) {
+	prompt := []int32{1, 2, 3, 4, 5, 2, 3, 6}
+
+	penalized := func(c *PromptCopy) []int32 {
+		tokens := toTokens(make([]float32, 8))
+		c.apply(tokens)
+
+		var ids []int32
+		for _, tok := range tokens {
+			if tok.value < 0 {
+				ids = append(ids, tok.id)
+			}
+		}
+		return ids
+	}
+
+	c, err := NewPromptCopy(prompt, nil, 2, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// copies shorter than the limit are not penalized
+	for _, id := range []int32{1, 2} {
+		if got := penalized(c); len(got) != 0 {
+			t.Errorf("before accepting %d: want nothing penalized, got %v", id, got)
+		}
+		c.accept(id)
+	}
+
+	// "2" appears twice in the prompt so both continuations are penalized
+	c.accept(3)
+	if want, got := []int32{4, 6}, penalized(c); !slices.Equal(want, got) {
+		t.Errorf("after copying 1 2 3: want %v penalized, got %v", want, got)
+	}
+
+	// breaking the copy clears the penalty
+	c.accept(7)
+	if got := penalized(c); len(got) != 0 {
+		t.Errorf("after breaking the copy: want nothing penalized, got %v", got)
+	}
+
+	// the generated suffix is taken into account and the penalty is subtracted
+	c, err = NewPromptCopy(prompt, []int32{7, 4, 5}, 2, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens := toTokens([]float32{0, 0, 3, 0, 0, 0, 0, 0})
+	c.apply(tokens)
+	if tokens[2].value != -7 {
+		t.Errorf("want penalized logit -7, got %f", tokens[2].value)
+	}
+
+	if _, err := NewPromptCopy(prompt, nil, 0, 1); err == nil {
+		t.Error("expected error for zero copy length")
+	}
+
+	if _, err := NewPromptCopy(prompt, nil, 1, -1); err == nil {
+		t.Error("expected error for negative penalty")
+	}
+}
+
+func TestAntislop(t *testing.T) {
+	vocab := []string{"As", " an", " AI", " a", "I", "del", "ve", " into", " in", " the", "delve"}
+	decode := func(id int32) string { return vocab[id] }
+
+	masked := func(a *Antislop) []string {
+		tokens := toTokens(make([]float32, len(vocab)))
+		a.apply(tokens)
+
+		var pieces []string
+		for _, tok := range tokens {
+			if math.IsInf(float64(tok.value), -1) {
+				pieces = append(pieces, vocab[tok.id])
+			}
+		}
+		return pieces
+	}
+
+	a := NewAntislop([]string{"as an AI", "delve into"}, decode)
+	if got := masked(a); len(got) != 0 {
+		t.Errorf("before any tokens: want nothing masked, got %v", got)
+	}
+
+	// matching ignores case and spans token boundaries
+	a.accept(0)
+	a.accept(1)
+	if want, got := []string{" AI"}, masked(a); !slices.Equal(want, got) {
+		t.Errorf("after \"As an\": want %v masked, got %v", want, got)
+	}
+
+	// the phrase can also be completed by shorter tokens
+	a.accept(3)
+	if want, got := []string{"I"}, masked(a); !slices.Equal(want, got) {
+		t.Errorf("after \"As an a\": want %v masked, got %v", want, got)
+	}
+
+	// a partial match needs its whole phrase
+	a = NewAntislop([]string{"as an AI", "delve into"}, decode)
+	a.accept(1)
+	a.accept(3)
+	if got := masked(a); len(got) != 0 {
+		t.Errorf("after \" an a\": want nothing masked, got %v", got)
+	}
+
+	// safe continuations of a partial match are allowed
+	a = NewAntislop([]string{"as an AI", "delve into"}, decode)
+	a.accept(5)
+	a.accept(6)
+	if want, got := []string{" into"}, masked(a); !slices.Equal(want, got) {
+		t.Errorf("after \"delve\": want %v masked, got %v", want, got)
+	}
+
+	a.accept(8)
+	if got := masked(a); len(got) != 0 {
+		t.Errorf("after \"delve in\": want nothing masked, got %v", got)
+	}
+
+	// without phrases nothing is masked
+	a = NewAntislop(nil, decode)
+	if got := masked(a); len(got) != 0 {
+		t.Errorf("no phrases: want nothing masked, got %v", got)
+	}
+}
+
+func TestBannedSubstrings(t *testing.T) {
+	vocab := []string{"se", "cret", "cre", "t", "s", "ecret", "secret", " ok", "c"}
+	decode := func(id int32) string { return vocab[id] }
+
+	masked := func(b *BannedSubstrings) []string {
+		tokens := toTokens(make([]float32, len(vocab)))
+		b.apply(tokens)
+
+		var ids []string
+		for _, tok := range tokens {
+			if math.IsInf(float64(tok.value), -1) {
+				ids = append(ids, vocab[tok.id])
+			}
+		}
+		return ids
+	}
+
+	b := NewBannedSubstrings([]string{"secret"}, "the ", decode)
+	if want, got := []string{"secret"}, masked(b); !slices.Equal(want, got) {
+		t.Errorf("want %v masked, got %v", want, got)
+	}
+
+	// the banned substring spans token boundaries
+	b.accept(0)
+	if want, got := []string{"cret", "secret"}, masked(b); !slices.Equal(want, got) {
+		t.Errorf("after \"se\": want %v masked, got %v", want, got)
+	}
+
+	b.accept(2)
+	if want, got := []string{"t", "secret"}, masked(b); !slices.Equal(want, got) {
+		t.Errorf("after \"secre\": want %v masked, got %v", want, got)
+	}
+
+	// the initial text counts towards a banned substring
+	b = NewBannedSubstrings([]string{"secret"}, "my s", decode)
+	if want, got := []string{"ecret", "secret"}, masked(b); !slices.Equal(want, got) {
+		t.Errorf("after \"my s\": want %v masked, got %v", want, got)
+	}
+
+	// text that already contains a banned substring does not mask everything
+	b = NewBannedSubstrings([]string{"secret"}, "a secret", decode)
+	if want, got := []string{"secret"}, masked(b); !slices.Equal(want, got) {
+		t.Errorf("after \"a secret\": want %v masked, got %v", want, got)
+	}
+}
+
+func TestReranker(t *testing.T) {
+	logits := []float32{1, 4, 3, 2}
+
+	var scored []int32
+	r := NewReranker(2, func(ids []int32) []float32 {
+		scored = slices.Clone(ids)
+
+		// prefer token 2 over token 1
+		scores := make([]float32, len(ids))
+		for i, id := range ids {
+			if id == 2 {
+				scores[i] = 5
+			}
+		}
+		return scores
+	})
+
+	tokens := toTokens(logits)
+	r.apply(tokens)
+	if !slices.Equal(scored, []int32{1, 2}) {
+		t.Errorf("scorer should receive the top 2 tokens, got %v", scored)
+	}
+	inf := float32(math.Inf(-1))
+	compareLogits(t, "reranked", []float32{inf, 4, 8, inf}, tokens)
+
+	sampler := NewSampler(0, 0, 0, 0, 0, nil, r)
+	got, err := sampler.Sample(logits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 2 {
+		t.Errorf("reranking should select token 2, got %d", got)
+	}
+
+	// tokens masked by an earlier constraint are not scored
+	r = NewReranker(3, func(ids []int32) []float32 {
+		scored = slices.Clone(ids)
+		return make([]float32, len(ids))
+	})
+	sampler = NewSampler(0, 0, 0, 0, 0, nil, NewBannedTokens([]int32{0, 2, 3}), r)
+	got, err = sampler.Sample(logits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 1 || !slices.Equal(scored, []int32{1}) {
+		t.Errorf("scorer should only receive unmasked token 1, got %v and sampled %d", scored, got)
+	}
+
+	// scores are ignored if the scorer returns the wrong number of them
+	r = NewReranker(2, func([]int32) []float32 { return []float32{100} })
+	tokens = toTokens(logits)
+	r.apply(tokens)
+	compareLogits(t, "bad scorer", []float32{inf, 4, 3, inf}, tokens)
+}
+
+func TestUTF8(t *testing.T) {
+	// "é" is 0xc3 0xa9 and "€" is 0xe2 0x82 0xac
+	vocab := [][]byte{
+		[]byte("a"),
+		{0xc3},
+		{0xa9},
+		{0xe2},
+		{0x82, 0xac},
+		{0xa9, 'b'},
+		{0xff},
+		[]byte("é"),
+	}
+	u := NewUTF8(func(id int32) []byte { return vocab[id] })
+
+	kept := func() []int32 {
+		tokens := toTokens(make([]float32, len(vocab)))
+		u.apply(tokens)
+
+		var ids []int32
+		for _, tok := range tokens {
+			if !math.IsInf(float64(tok.value), -1) {
+				ids = append(ids, tok.id)
+			}
+		}
+		return ids
+	}
+
+	// continuation bytes and invalid bytes cannot start a character
+	if want, got := []int32{0, 1, 3, 7}, kept(); !slices.Equal(want, got) {
+		t.Errorf("start: want %v kept, got %v", want, got)
+	}
+
+	// after a two byte lead only a single continuation byte is valid
+	u.accept(1)
+	if want, got := []int32{2, 5}, kept(); !slices.Equal(want, got) {
+		t.Errorf("after 0xc3: want %v kept, got %v", want, got)
+	}
+
+	u.accept(5)
+	if want, got := []int32{0, 1, 3, 7}, kept(); !slices.Equal(want, got) {
+		t.Errorf("after complete character: want %v kept, got %v", want, got)
+	}
+
+	// after a three byte lead a continuation byte may leave the character
+	// incomplete but must not be followed by another character
+	u.accept(3)
+	if want, got := []int32{2, 4}, kept(); !slices.Equal(want, got) {
+		t.Errorf("after 0xe2: want %v kept, got %v", want, got)
+	}
+}
+
 func BenchmarkTransforms(b *testing.B) {
 	// Generate random logits
 	tokens := make([]token, 1<<16)
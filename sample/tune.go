@@ -0,0 +1,75 @@
+package sample
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// TopKLatency is the mean time taken to sample a token with a given top-k
+type TopKLatency struct {
+	K       int
+	Latency time.Duration
+}
+
+// MeasureTopK samples every logit vector in stream once for each candidate
+// top-k and returns the mean latency per token, ordered by k
+func MeasureTopK(stream [][]float32, ks []int) ([]TopKLatency, error) {
+	if len(stream) == 0 {
+		return nil, errors.New("sample: no logits to measure")
+	}
+
+	ks = slices.Clone(ks)
+	slices.Sort(ks)
+	ks = slices.Compact(ks)
+
+	latencies := make([]TopKLatency, 0, len(ks))
+	for _, k := range ks {
+		if k < 1 {
+			return nil, fmt.Errorf("sample: top-k must be at least 1, got %d", k)
+		}
+
+		sampler := NewSampler(1, k, 1, 0, 0, nil)
+		start := time.Now()
+		for _, logits := range stream {
+			if _, err := sampler.Sample(logits); err != nil {
+				return nil, err
+			}
+		}
+
+		latencies = append(latencies, TopKLatency{
+			K:       k,
+			Latency: time.Since(start) / time.Duration(len(stream)),
+		})
+	}
+
+	return latencies, nil
+}
+
+// RecommendTopK returns the largest k whose measured latency is within budget
+func RecommendTopK(latencies []TopKLatency, budget time.Duration) (int, error) {
+	best := 0
+	for _, l := range latencies {
+		if l.Latency <= budget && l.K > best {
+			best = l.K
+		}
+	}
+
+	if best == 0 {
+		return 0, fmt.Errorf("sample: no top-k fits within a latency budget of %s", budget)
+	}
+
+	return best, nil
+}
+
+// TuneTopK measures each candidate top-k against a representative stream of
+// logits and recommends the largest one that samples within budget
+func TuneTopK(stream [][]float32, ks []int, budget time.Duration) (int, error) {
+	latencies, err := MeasureTopK(stream, ks)
+	if err != nil {
+		return 0, err
+	}
+
+	return RecommendTopK(latencies, budget)
+}
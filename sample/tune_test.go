@@ -0,0 +1,117 @@
+package sample
+
+import (
+	"math/rand/v2"
+	"testing"
+	"time"
+)
+
+func TestRecommendTopK(t *testing.T) {
+	latencies := []TopKLatency{
+		{K: 1, Latency: 10 * time.Microsecond},
+		{K: 10, Latency: 20 * time.Microsecond},
+		{K: 100, Latency: 40 * time.Microsecond},
+		{K: 1000, Latency: 80 * time.Microsecond},
+	}
+
+	cases := []struct {
+		budget time.Duration
+		want   int
+	}{
+		{time.Millisecond, 1000},
+		{80 * time.Microsecond, 1000},
+		{50 * time.Microsecond, 100},
+		{20 * time.Microsecond, 10},
+		{15 * time.Microsecond, 1},
+	}
+
+	for _, tc := range cases {
+		got, err := RecommendTopK(latencies, tc.budget)
+		if err != nil {
+			t.Fatalf("budget %s: %v", tc.budget, err)
+		}
+		if got != tc.want {
+			t.Errorf("budget %s: want k %d, got %d", tc.budget, tc.want, got)
+		}
+	}
+
+	if _, err := RecommendTopK(latencies, time.Microsecond); err == nil {
+		t.Error("expected error when no k fits the budget")
+	}
+}
+
+func TestTuneTopK(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	stream := make([][]float32, 8)
+	for i := range stream {
+		stream[i] = make([]float32, 32000)
+		for j := range stream[i] {
+			stream[i][j] = rng.Float32() * 10
+		}
+	}
+
+	ks := []int{1, 10, 100, 1000, 10000}
+	latencies, err := MeasureTopK(stream, ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(latencies) != len(ks) {
+		t.Fatalf("want %d measurements, got %d", len(ks), len(latencies))
+	}
+
+	var slowest, fastest TopKLatency
+	for i, l := range latencies {
+		if i == 0 || l.Latency > slowest.Latency {
+			slowest = l
+		}
+		// latencies are ordered by k, so ties keep the larger k like RecommendTopK
+		if i == 0 || l.Latency <= fastest.Latency {
+			fastest = l
+		}
+	}
+
+	// the tightest budget that any k meets recommends the fastest k
+	k, err := RecommendTopK(latencies, fastest.Latency)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k != fastest.K {
+		t.Errorf("budget %s: want fastest k %d, got %d", fastest.Latency, fastest.K, k)
+	}
+
+	if _, err := RecommendTopK(latencies, fastest.Latency-1); err == nil {
+		t.Error("expected error for a budget below the fastest k")
+	}
+
+	// a budget just below the slowest k rules it out in favour of a faster one
+	if slowest.Latency > fastest.Latency {
+		k, err := RecommendTopK(latencies, slowest.Latency-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if k == slowest.K {
+			t.Errorf("budget %s: slowest k %d should be ruled out", slowest.Latency-1, k)
+		}
+		for _, l := range latencies {
+			if l.K == k && l.Latency >= slowest.Latency {
+				t.Errorf("budget %s: recommended k %d takes %s", slowest.Latency-1, k, l.Latency)
+			}
+		}
+	}
+
+	if k, err := TuneTopK(stream, ks, time.Hour); err != nil || k != 10000 {
+		t.Errorf("generous budget: want k 10000, got %d (%v)", k, err)
+	}
+
+	if _, err := TuneTopK(stream, ks, 0); err == nil {
+		t.Error("expected error for zero budget")
+	}
+
+	if _, err := MeasureTopK(nil, ks); err == nil {
+		t.Error("expected error for empty stream")
+	}
+
+	if _, err := MeasureTopK(stream, []int{0}); err == nil {
+		t.Error("expected error for zero k")
+	}
+}